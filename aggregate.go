@@ -0,0 +1,358 @@
+package binlog
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	kafka "github.com/segmentio/kafka-go"
+)
+
+const (
+	LocalCluster     = "local"
+	AggregateCluster = "aggregate"
+
+	DefaultAggregateTopic     = "{topic}"
+	DefaultAggregateMaxBuffer = 100000
+)
+
+// aggregateConfig selects the events mirrored to the aggregate brokers and where they go.
+type aggregateConfig struct {
+	Enabled bool `json:"_enabled,omitempty"`
+	// Topics are regular expressions matched against the local topic of an event, every
+	// topic is mirrored when there are none.
+	Topics []string `json:"_topics,omitempty"`
+	// Topic routes the mirrored events, {topic} is replaced by the local topic and
+	// {schema} and {table} by the event's table. The topic of a shard's events is prefixed
+	// with the shard id.
+	Topic string `json:"_topic,omitempty"`
+	// MaxBuffer is how many messages wait for the aggregate cluster, so that an outage of
+	// it can't hold up the local cluster. Once it is full mirroring stops until the
+	// aggregate cluster is back and the events are replayed from its own checkpoint. The
+	// oldest messages are dropped instead when there are no checkpoints.
+	MaxBuffer int `json:"_max_buffer,omitempty"`
+}
+
+// NewAggregateProducer creates a producer for the aggregate brokers with the same client,
+// TLS and SASL settings as the local ones.
+func (k *kafkaConfig) NewAggregateProducer() (Producer, error) {
+	return k.aggregate().NewProducer()
+}
+
+// NewAggregateCheckpointStore returns a store for source on the checkpoint topic of the
+// aggregate brokers, producer must write to them.
+func (k *kafkaConfig) NewAggregateCheckpointStore(ctx context.Context, producer Producer, source string) (CheckpointStore, error) {
+	return k.aggregate().NewCheckpointStore(ctx, producer, source)
+}
+
+// aggregate returns the config of the aggregate brokers.
+func (k *kafkaConfig) aggregate() *kafkaConfig {
+	aggregate := *k
+	aggregate.Brokers.Local = k.Brokers.Aggregate
+	return &aggregate
+}
+
+// aggregateMirror keeps the events mirrored to the aggregate cluster apart from the local
+// ones. They are buffered and written on their own so that either cluster can fall behind
+// without holding up the other.
+type aggregateMirror struct {
+	producer Producer
+	shard    string
+	logger   Logger
+	topics   []*regexp.Regexp
+	template string
+	max      int
+
+	sync *sync.Mutex
+	msgs []kafka.Message
+	// txn holds the mirrored messages of the transaction being read.
+	txn []kafka.Message
+
+	// checkpoints keeps the position of the last transaction written to the aggregate
+	// cluster, written, apart from the local one. position is where the buffered messages
+	// end and committed is the last transaction read.
+	checkpoints CheckpointStore
+	written     *Checkpoint
+	position    *Checkpoint
+	committed   *Checkpoint
+	// skip is the transaction the mirror has already read when the canal was restarted
+	// from an earlier position, the ones up to it are not mirrored again.
+	skip *Checkpoint
+	// behind is set once the buffer was full, nothing is mirrored until replay is set when
+	// the aggregate cluster is back and the canal restarts from written.
+	behind bool
+	replay bool
+	// drained is signalled after every write. A replay waits for the buffer to drain
+	// rather than filling it up again, see waitForRoom.
+	drained *sync.Cond
+	failed  bool
+	stopped bool
+}
+
+func newAggregateMirror(producer Producer, config *aggregateConfig, shard string, logger Logger) (*aggregateMirror, error) {
+	m := &aggregateMirror{
+		producer: producer,
+		shard:    shard,
+		logger:   logger,
+		template: config.Topic,
+		max:      config.MaxBuffer,
+		sync:     new(sync.Mutex),
+	}
+	m.drained = sync.NewCond(m.sync)
+	if m.template == "" {
+		m.template = DefaultAggregateTopic
+	}
+	if m.max == 0 {
+		m.max = DefaultAggregateMaxBuffer
+	}
+	for _, expr := range config.Topics {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid aggregate topic regex %q", expr)
+		}
+		m.topics = append(m.topics, re)
+	}
+	return m, nil
+}
+
+// topic returns where the local topic's events are mirrored to, it is empty when they are
+// not mirrored.
+func (m *aggregateMirror) topic(local string, t TableInfo) (string, error) {
+	selected := len(m.topics) == 0
+	for _, re := range m.topics {
+		if re.MatchString(local) {
+			selected = true
+			break
+		}
+	}
+	if !selected {
+		return "", nil
+	}
+
+	topic := strings.NewReplacer("{topic}", local, "{schema}", t.Schema, "{table}", t.Name).Replace(m.template)
+	if m.shard != "" {
+		topic = m.shard + "." + topic
+	}
+	if !validTopic.MatchString(topic) {
+		return "", errors.Errorf("invalid aggregate topic %q routed from %s", topic, local)
+	}
+	return topic, nil
+}
+
+// mirror copies the messages of a table that are selected. They are only written once
+// the transaction they are part of is committed, or right away when inTxn isn't set. A
+// message that can't be routed is dropped rather than stopping the local pipeline.
+func (m *aggregateMirror) mirror(msgs []kafka.Message, t TableInfo, inTxn bool) {
+	var mirrored []kafka.Message
+	for _, msg := range msgs {
+		topic, err := m.topic(msg.Topic, t)
+		if err != nil {
+			m.logger.WithError(err).WithField("shard", m.shard).Warn("Not mirroring message to the aggregate cluster")
+			aggregateDropped.WithLabelValues(m.shard).Inc()
+			continue
+		}
+		if topic == "" {
+			continue
+		}
+		msg.Topic = topic
+		mirrored = append(mirrored, msg)
+	}
+
+	m.sync.Lock()
+	defer m.sync.Unlock()
+	if inTxn {
+		m.txn = append(m.txn, mirrored...)
+	} else {
+		m.buffer(mirrored)
+	}
+}
+
+// waitForRoom waits until the transaction being read fits in the buffer, unless the last
+// write failed or the mirror stopped. It must not be called with the handler's lock held,
+// the writes that make room need it.
+func (m *aggregateMirror) waitForRoom() {
+	m.sync.Lock()
+	defer m.sync.Unlock()
+	for !m.behind && !m.failed && !m.stopped && len(m.msgs) > 0 && len(m.msgs)+len(m.txn) > m.max {
+		m.drained.Wait()
+	}
+}
+
+// commit moves the messages of the transaction that was read, which ends at cp, to the
+// buffer.
+func (m *aggregateMirror) commit(cp *Checkpoint) {
+	m.sync.Lock()
+	defer m.sync.Unlock()
+	txn := m.txn
+	m.txn = nil
+	if m.skip != nil {
+		if !cp.after(m.skip) {
+			return
+		}
+		m.skip = nil
+	}
+	m.committed = cp
+	if m.behind {
+		return
+	}
+	m.buffer(txn)
+	if !m.behind {
+		m.position = cp
+	}
+}
+
+// restart drops the messages of a transaction that will be read again, and returns the
+// checkpoint the canal has to restart from for the mirror not to miss anything. It is nil
+// when any will do.
+func (m *aggregateMirror) restart() *Checkpoint {
+	m.sync.Lock()
+	defer m.sync.Unlock()
+	m.txn = nil
+	if m.behind && !m.replay {
+		return nil
+	}
+	if m.replay {
+		m.logger.WithFields(Fields{
+			"shard":      m.shard,
+			"checkpoint": m.written,
+		}).Info("Replaying the events the aggregate cluster missed")
+		m.behind, m.replay = false, false
+		m.committed = m.written
+	}
+	m.skip = m.committed
+	return m.committed
+}
+
+// start sets where the mirror is when the canal starts from cp, it is the aggregate
+// cluster's checkpoint when there is one.
+func (m *aggregateMirror) start(cp *Checkpoint) *Checkpoint {
+	m.sync.Lock()
+	defer m.sync.Unlock()
+	if m.written == nil {
+		m.written = cp
+	}
+	m.committed, m.skip = m.written, m.written
+	return m.written
+}
+
+// replaying reports whether the canal has to be restarted for the aggregate cluster to
+// catch up.
+func (m *aggregateMirror) replaying() bool {
+	m.sync.Lock()
+	defer m.sync.Unlock()
+	return m.replay
+}
+
+// buffer must be called with the lock held.
+func (m *aggregateMirror) buffer(msgs []kafka.Message) {
+	m.msgs = append(m.msgs, msgs...)
+	if over := len(m.msgs) - m.max; over > 0 && m.checkpoints != nil && m.written != nil {
+		// the messages are mirrored again once the aggregate cluster is back.
+		m.logger.WithFields(Fields{
+			"shard":      m.shard,
+			"checkpoint": m.written,
+		}).Warn("Aggregate buffer is full, mirroring stops until the aggregate cluster is back")
+		m.msgs, m.position, m.behind = nil, nil, true
+	} else if over > 0 {
+		m.logger.WithFields(Fields{
+			"shard":   m.shard,
+			"dropped": over,
+		}).Warn("Aggregate buffer is full, dropping the oldest messages")
+		aggregateDropped.WithLabelValues(m.shard).Add(float64(over))
+		m.msgs = append([]kafka.Message(nil), m.msgs[over:]...)
+	}
+	aggregateBufferDepth.WithLabelValues(m.shard).Set(float64(len(m.msgs)))
+}
+
+func (m *aggregateMirror) write(c context.Context) error {
+	ctx, cancel := context.WithTimeout(c, 10*time.Second)
+	defer cancel()
+	m.sync.Lock()
+	msgs, pos, behind := m.msgs, m.position, m.behind
+	m.msgs, m.position = nil, nil
+	m.sync.Unlock()
+
+	err := m.send(ctx, msgs, pos, behind)
+	m.sync.Lock()
+	m.failed = err != nil
+	m.drained.Broadcast()
+	m.sync.Unlock()
+	return err
+}
+
+// send writes msgs and then pos to the aggregate cluster, or only checks whether it is
+// back when the mirror is behind.
+func (m *aggregateMirror) send(ctx context.Context, msgs []kafka.Message, pos *Checkpoint, behind bool) error {
+	if behind {
+		// saving the checkpoint again tells when the aggregate cluster is back.
+		if err := m.checkpoints.Save(ctx, m.written); err != nil {
+			return err
+		}
+		m.sync.Lock()
+		m.replay = true
+		m.sync.Unlock()
+		return nil
+	}
+
+	if len(msgs) > 0 {
+		start := time.Now()
+		err := m.producer.WriteMessages(ctx, msgs...)
+		observeWrite(AggregateCluster, start, msgs, err)
+		if err != nil {
+			m.requeue(msgs, pos)
+			return err
+		}
+	}
+	if m.checkpoints != nil && pos != nil {
+		pos.Time = time.Now()
+		if err := m.checkpoints.Save(ctx, pos); err != nil {
+			m.requeue(nil, pos)
+			return err
+		}
+		m.sync.Lock()
+		m.written = pos
+		m.sync.Unlock()
+	}
+	m.sync.Lock()
+	aggregateBufferDepth.WithLabelValues(m.shard).Set(float64(len(m.msgs)))
+	m.sync.Unlock()
+	return nil
+}
+
+// requeue puts the messages that failed to be written back in front so they are retried
+// in order.
+func (m *aggregateMirror) requeue(msgs []kafka.Message, pos *Checkpoint) {
+	m.sync.Lock()
+	defer m.sync.Unlock()
+	if m.behind {
+		// the buffer filled up in the meantime, the messages are replayed.
+		return
+	}
+	pending := m.msgs
+	m.msgs = msgs
+	if m.position == nil {
+		m.position = pos
+	}
+	m.buffer(pending)
+}
+
+// run writes the buffered messages every interval until ctx is done.
+func (m *aggregateMirror) run(ctx context.Context, interval func() time.Duration) {
+	for {
+		select {
+		case <-time.After(interval()):
+			if err := m.write(ctx); err != nil {
+				m.logger.WithError(err).WithField("shard", m.shard).Warn("Unable to mirror events to the aggregate cluster")
+			}
+		case <-ctx.Done():
+			m.sync.Lock()
+			m.stopped = true
+			m.drained.Broadcast()
+			m.sync.Unlock()
+			return
+		}
+	}
+}
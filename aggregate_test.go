@@ -0,0 +1,265 @@
+package binlog
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	kafka "github.com/segmentio/kafka-go"
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+var errClusterDown = errors.New("cluster down")
+
+// fakeCluster stands in for a kafka cluster, both as a producer and a checkpoint store.
+type fakeCluster struct {
+	down       bool
+	written    []string
+	checkpoint *Checkpoint
+	// delay slows every write down.
+	delay time.Duration
+	sync  sync.Mutex
+}
+
+func (c *fakeCluster) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	time.Sleep(c.delay)
+	c.sync.Lock()
+	defer c.sync.Unlock()
+	if c.down {
+		return errClusterDown
+	}
+	for _, msg := range msgs {
+		c.written = append(c.written, string(msg.Value))
+	}
+	return nil
+}
+
+func (c *fakeCluster) Close() error { return nil }
+
+func (c *fakeCluster) Load(ctx context.Context) (*Checkpoint, error) {
+	return c.checkpoint, nil
+}
+
+func (c *fakeCluster) Save(ctx context.Context, cp *Checkpoint) error {
+	c.sync.Lock()
+	defer c.sync.Unlock()
+	if c.down {
+		return errClusterDown
+	}
+	c.checkpoint = cp
+	return nil
+}
+
+func binlogPos(pos uint32) mysql.Position {
+	return mysql.Position{Name: "mysql-bin.000001", Pos: pos}
+}
+
+// readTxn feeds a transaction of one event per value to h, the way OnRow does, and syncs
+// the position after it.
+func readTxn(t *testing.T, h *kafkaBlogEventHandler, pos uint32, values ...string) error {
+	var msgs []kafka.Message
+	for _, v := range values {
+		msgs = append(msgs, kafka.Message{Topic: "events", Value: []byte(v)})
+	}
+	h.sync.Lock()
+	h.txn = append(h.txn, msgs...)
+	h.sync.Unlock()
+	h.mirror.mirror(msgs, TableInfo{Schema: "sales", Name: "sales"}, true)
+	return h.OnPosSynced(binlogPos(pos), nil, false)
+}
+
+func TestAggregateReplaysFromItsCheckpoint(t *testing.T) {
+	local, aggregate := &fakeCluster{}, &fakeCluster{}
+	aggregate.checkpoint = &Checkpoint{Position: binlogPos(100)}
+	h := NewKafkaEventHandler(local, nil)
+	h.EnableCheckpoints(local)
+	if err := h.EnableAggregate(aggregate, &aggregateConfig{Enabled: true, MaxBuffer: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.EnableAggregateCheckpoints(context.Background(), aggregate); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if cp := h.Resume(&Checkpoint{Position: binlogPos(100)}); cp.Position != binlogPos(100) {
+		t.Fatalf("resuming from %v", cp.Position)
+	}
+
+	// the aggregate cluster goes down and its buffer fills up.
+	aggregate.down = true
+	for i, values := range [][]string{{"a"}, {"b", "c"}, {"d"}} {
+		if err := readTxn(t, h, uint32(200+i*100), values...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := h.WriteEvents(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.mirror.write(ctx); err == nil {
+		t.Fatal("expected the aggregate cluster to be down")
+	}
+	if !h.mirror.behind || len(h.mirror.msgs) != 0 {
+		t.Fatalf("mirror not behind with %d buffered messages", len(h.mirror.msgs))
+	}
+
+	// transactions read while it is behind are only written locally.
+	if err := readTxn(t, h, 500, "e"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.WriteEvents(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// once it is back the canal stops to replay.
+	aggregate.down = false
+	if err := h.mirror.write(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := readTxn(t, h, 600, "f"); err != errReplayAggregate {
+		t.Fatalf("got %v, want the canal to stop for the replay", err)
+	}
+	cp := h.restart()
+	if cp == nil || cp.Position != binlogPos(100) {
+		t.Fatalf("restarting from %+v, want the aggregate checkpoint", cp)
+	}
+
+	// the canal reads everything after the aggregate checkpoint again, waiting for the
+	// aggregate cluster instead of filling its buffer up.
+	replayed := make(chan error, 1)
+	go func() {
+		for i, values := range [][]string{{"a"}, {"b", "c"}, {"d"}, {"e"}, {"f"}} {
+			if err := readTxn(t, h, uint32(200+i*100), values...); err != nil {
+				replayed <- err
+				return
+			}
+		}
+		replayed <- nil
+	}()
+	for done := false; !done; {
+		select {
+		case err := <-replayed:
+			if err != nil {
+				t.Fatal(err)
+			}
+			done = true
+		case <-time.After(time.Millisecond):
+		}
+		if err := h.mirror.write(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if h.mirror.behind {
+		t.Fatal("mirror fell behind during the replay")
+	}
+	if _, err := h.WriteEvents(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := local.written, []string{"a", "b", "c", "d", "e", "f"}; !equalStrings(got, want) {
+		t.Errorf("local cluster got %v, want %v", got, want)
+	}
+	if got, want := aggregate.written, []string{"a", "b", "c", "d", "e", "f"}; !equalStrings(got, want) {
+		t.Errorf("aggregate cluster got %v, want %v", got, want)
+	}
+	if local.checkpoint.Position != binlogPos(600) || aggregate.checkpoint.Position != binlogPos(600) {
+		t.Errorf("got checkpoints %v and %v, want both at 600", local.checkpoint.Position, aggregate.checkpoint.Position)
+	}
+}
+
+func (c *fakeCluster) count() int {
+	c.sync.Lock()
+	defer c.sync.Unlock()
+	return len(c.written)
+}
+
+func TestAggregateReplayWithAutoEmit(t *testing.T) {
+	local, aggregate := &fakeCluster{}, &fakeCluster{delay: 5 * time.Millisecond}
+	aggregate.checkpoint = &Checkpoint{Position: binlogPos(100)}
+	h := NewKafkaEventHandler(local, nil)
+	h.EnableCheckpoints(local)
+	if err := h.EnableAggregate(aggregate, &aggregateConfig{Enabled: true, MaxBuffer: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.EnableAggregateCheckpoints(context.Background(), aggregate); err != nil {
+		t.Fatal(err)
+	}
+	// the local cluster is far ahead, everything read is replayed to the aggregate one.
+	if cp := h.Resume(&Checkpoint{Position: binlogPos(100000)}); cp.Position != binlogPos(100) {
+		t.Fatalf("resuming from %v", cp.Position)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := h.AutoEmit(ctx, time.Millisecond)
+
+	replayed := make(chan error, 1)
+	go func() {
+		for i := 0; i < 20; i++ {
+			if err := readTxn(t, h, uint32(200+i*100), fmt.Sprint(2*i), fmt.Sprint(2*i+1)); err != nil {
+				replayed <- err
+				return
+			}
+		}
+		replayed <- nil
+	}()
+	select {
+	case err := <-replayed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the replay is stuck")
+	}
+	for deadline := time.Now().Add(5 * time.Second); aggregate.count() < 40; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("aggregate cluster got %d messages, want 40", aggregate.count())
+		}
+	}
+	cancel()
+	<-stopped
+
+	h.mirror.sync.Lock()
+	behind := h.mirror.behind
+	h.mirror.sync.Unlock()
+	if behind {
+		t.Fatal("mirror fell behind during the replay")
+	}
+	for i, v := range aggregate.written {
+		if v != fmt.Sprint(i) {
+			t.Fatalf("aggregate cluster got %v out of order", aggregate.written)
+		}
+	}
+	if n := local.count(); n != 0 {
+		t.Errorf("local cluster got %d messages it already had", n)
+	}
+}
+
+func TestAggregateDropsWithoutCheckpoints(t *testing.T) {
+	aggregate := &fakeCluster{down: true}
+	h := NewKafkaEventHandler(&fakeCluster{}, nil)
+	if err := h.EnableAggregate(aggregate, &aggregateConfig{Enabled: true, MaxBuffer: 2}); err != nil {
+		t.Fatal(err)
+	}
+	for i, values := range [][]string{{"a"}, {"b", "c"}} {
+		if err := readTxn(t, h, uint32(200+i*100), values...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if h.mirror.behind || len(h.mirror.msgs) != 2 || string(h.mirror.msgs[0].Value) != "b" {
+		t.Fatalf("got buffer %v, want the oldest message dropped", h.mirror.msgs)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,274 @@
+package binlog
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+const ArchiveManifestName = "manifest.json"
+
+// ArchivedFile is a binlog file copied into the archive. Everything up to Pos in the
+// binlog, which is Size bytes of the archived file, has been synced to disk.
+type ArchivedFile struct {
+	Name       string    `json:"name"`
+	Path       string    `json:"path"`
+	Pos        uint32    `json:"pos"`
+	Size       int64     `json:"size"`
+	Compressed bool      `json:"compressed"`
+	Started    time.Time `json:"started"`
+	Updated    time.Time `json:"updated"`
+}
+
+// ArchiveManifest lists the archived binlog files in the order they were written.
+type ArchiveManifest struct {
+	Files []*ArchivedFile `json:"files"`
+}
+
+// ReadArchiveManifest returns an empty manifest when the archive has none yet.
+func ReadArchiveManifest(dir string) (*ArchiveManifest, error) {
+	m := &ArchiveManifest{}
+	b, err := ioutil.ReadFile(filepath.Join(dir, ArchiveManifestName))
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, errors.Wrap(err, "invalid archive manifest")
+	}
+	return m, nil
+}
+
+func (m *ArchiveManifest) file(name string) *ArchivedFile {
+	for _, f := range m.Files {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// write replaces the manifest atomically so a crash never leaves it half written.
+func (m *ArchiveManifest) write(dir string) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, ArchiveManifestName+".tmp")
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, ArchiveManifestName))
+}
+
+// Archiver writes the raw events read from the binlog to files named after the binlog
+// files they came from, like mysqlbinlog --raw. Compressed files are a series of gzip
+// members, one per sync, so that they can be resumed after the last one.
+type Archiver struct {
+	dir      string
+	compress bool
+	manifest *ArchiveManifest
+
+	sync    *sync.Mutex
+	current *ArchivedFile
+	f       *os.File
+	gz      *gzip.Writer
+	size    int64
+	pos     uint32
+}
+
+func NewArchiver(dir string, compress bool) (*Archiver, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "cannot create archive directory")
+	}
+	m, err := ReadArchiveManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Archiver{
+		dir:      dir,
+		compress: compress,
+		manifest: m,
+		sync:     new(sync.Mutex),
+	}, nil
+}
+
+// Position is where syncing has to start from to continue the archive. It is empty when
+// nothing has been archived yet.
+func (a *Archiver) Position() mysql.Position {
+	a.sync.Lock()
+	defer a.sync.Unlock()
+	if len(a.manifest.Files) == 0 {
+		return mysql.Position{}
+	}
+	last := a.manifest.Files[len(a.manifest.Files)-1]
+	return mysql.Position{Name: last.Name, Pos: last.Pos}
+}
+
+// Write appends an event to the file of the binlog it was read from.
+func (a *Archiver) Write(ev *replication.BinlogEvent) error {
+	a.sync.Lock()
+	defer a.sync.Unlock()
+
+	// the server sends heartbeats and, when syncing starts, a rotate and a format
+	// description that are not part of the binlog. They have no position.
+	if ev.Header.EventType == replication.HEARTBEAT_EVENT {
+		return nil
+	}
+	if ev.Header.LogPos != 0 {
+		if a.f == nil {
+			return errors.Errorf("%s event at %d before any rotate event", ev.Header.EventType, ev.Header.LogPos)
+		}
+		if err := a.append(ev.RawData); err != nil {
+			return errors.Wrapf(err, "cannot archive %s", a.current.Name)
+		}
+		a.pos = ev.Header.LogPos
+	}
+
+	if rotate, ok := ev.Event.(*replication.RotateEvent); ok {
+		return a.rotate(string(rotate.NextLogName), uint32(rotate.Position))
+	}
+	return nil
+}
+
+func (a *Archiver) append(b []byte) error {
+	if a.compress {
+		if a.gz == nil {
+			a.gz = gzip.NewWriter(a.f)
+		}
+		_, err := a.gz.Write(b)
+		return err
+	}
+	n, err := a.f.Write(b)
+	a.size += int64(n)
+	return err
+}
+
+// rotate closes the current file and opens the one for name, continuing it when pos is
+// past what has already been archived of it.
+func (a *Archiver) rotate(name string, pos uint32) error {
+	if a.current != nil && a.current.Name == name && a.f != nil {
+		return nil
+	}
+	if err := a.closeFile(); err != nil {
+		return err
+	}
+
+	existing := a.manifest.file(name)
+	if existing != nil && pos > 4 {
+		if pos != existing.Pos {
+			return errors.Errorf("cannot continue %s at %d, it is archived up to %d", name, pos, existing.Pos)
+		}
+		return a.open(existing)
+	}
+
+	path := name
+	if a.compress {
+		path += ".gz"
+	}
+	f := &ArchivedFile{
+		Name:       name,
+		Path:       path,
+		Compressed: a.compress,
+		Started:    time.Now(),
+	}
+	if existing != nil {
+		// the binlog is being archived from its start again.
+		*existing = *f
+		f = existing
+	} else {
+		a.manifest.Files = append(a.manifest.Files, f)
+	}
+	if err := a.open(f); err != nil {
+		return err
+	}
+	if err := a.append(replication.BinLogFileHeader); err != nil {
+		return err
+	}
+	a.pos = 4
+	return a.syncFile()
+}
+
+// open opens f for appending, dropping anything written after its last sync.
+func (a *Archiver) open(f *ArchivedFile) error {
+	if f.Compressed != a.compress {
+		return errors.Errorf("cannot continue %s with compression %t", f.Name, a.compress)
+	}
+	file, err := os.OpenFile(filepath.Join(a.dir, f.Path), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(f.Size); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Seek(f.Size, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+	defaultLogger.WithFields(Fields{
+		"file": f.Name,
+		"pos":  f.Pos,
+	}).Info("Archiving binlog file")
+	a.current, a.f, a.size, a.pos = f, file, f.Size, f.Pos
+	return nil
+}
+
+// Sync flushes the current file to disk and records how much of it has been archived.
+func (a *Archiver) Sync() error {
+	a.sync.Lock()
+	defer a.sync.Unlock()
+	return a.syncFile()
+}
+
+func (a *Archiver) syncFile() error {
+	if a.f == nil {
+		return nil
+	}
+	if a.gz != nil {
+		if err := a.gz.Close(); err != nil {
+			return err
+		}
+		a.gz = nil
+	}
+	if err := a.f.Sync(); err != nil {
+		return err
+	}
+	if a.compress {
+		size, err := a.f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		a.size = size
+	}
+	a.current.Pos, a.current.Size, a.current.Updated = a.pos, a.size, time.Now()
+	return errors.Wrap(a.manifest.write(a.dir), "cannot write archive manifest")
+}
+
+func (a *Archiver) closeFile() error {
+	if a.f == nil {
+		return nil
+	}
+	err := a.syncFile()
+	if cerr := a.f.Close(); err == nil {
+		err = cerr
+	}
+	a.f, a.current = nil, nil
+	return err
+}
+
+func (a *Archiver) Close() error {
+	a.sync.Lock()
+	defer a.sync.Unlock()
+	return a.closeFile()
+}
@@ -0,0 +1,142 @@
+package binlog
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	kafka "github.com/segmentio/kafka-go"
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+const DefaultCheckpointTopic = "binlog_offsets"
+
+// Checkpoint is the binlog position up to which every event of a source has been written
+// to kafka.
+type Checkpoint struct {
+	Source   string         `json:"source"`
+	Position mysql.Position `json:"position"`
+	// GTIDSet is the set of transactions written, in the format of Flavor. It is empty
+	// when the server doesn't use GTIDs.
+	GTIDSet string    `json:"gtid_set,omitempty"`
+	Flavor  string    `json:"flavor,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// GTIDs parses the checkpoint's GTID set, it is nil when there is none.
+func (cp *Checkpoint) GTIDs() (mysql.GTIDSet, error) {
+	if cp.GTIDSet == "" {
+		return nil, nil
+	}
+	set, err := mysql.ParseGTIDSet(cp.Flavor, cp.GTIDSet)
+	return set, errors.Wrapf(err, "invalid %s gtid set in checkpoint", cp.Flavor)
+}
+
+// after reports whether cp covers transactions that than doesn't. Checkpoints are compared
+// by their GTID sets when both have one of the same flavor, by their positions otherwise.
+func (cp *Checkpoint) after(than *Checkpoint) bool {
+	if cp.GTIDSet != "" && than.GTIDSet != "" && cp.Flavor == than.Flavor {
+		set, err := cp.GTIDs()
+		if err == nil {
+			var thanSet mysql.GTIDSet
+			if thanSet, err = than.GTIDs(); err == nil {
+				return !thanSet.Contain(set)
+			}
+		}
+	}
+	return cp.Position.Compare(than.Position) > 0
+}
+
+// earliestCheckpoint returns whichever of a and b is before the other, nil ones are
+// ignored.
+func earliestCheckpoint(a, b *Checkpoint) *Checkpoint {
+	if a == nil || (b != nil && a.after(b)) {
+		return b
+	}
+	return a
+}
+
+// CheckpointStore persists checkpoints so that the pipeline can resume where it left off.
+type CheckpointStore interface {
+	// Load returns nil when nothing has been checkpointed for the source yet.
+	Load(ctx context.Context) (*Checkpoint, error)
+	Save(ctx context.Context, cp *Checkpoint) error
+}
+
+// kafkaCheckpointStore keeps checkpoints in a compacted topic keyed by source, so only the
+// latest checkpoint of every source is retained.
+type kafkaCheckpointStore struct {
+	config   *kafkaConfig
+	producer Producer
+	topic    string
+	source   string
+}
+
+// NewCheckpointStore creates the compacted checkpoint topic if needed and returns a store
+// for source on it.
+func (k *kafkaConfig) NewCheckpointStore(ctx context.Context, producer Producer, source string) (CheckpointStore, error) {
+	topic := k.CheckpointTopic
+	if topic == "" {
+		topic = DefaultCheckpointTopic
+	}
+	if err := k.EnsureCompactedTopic(ctx, topic, 1); err != nil {
+		return nil, err
+	}
+	return &kafkaCheckpointStore{
+		config:   k,
+		producer: producer,
+		topic:    topic,
+		source:   source,
+	}, nil
+}
+
+func (s *kafkaCheckpointStore) Load(ctx context.Context) (*Checkpoint, error) {
+	var cp *Checkpoint
+	err := s.config.ReadTopic(ctx, s.topic, func(m kafka.Message) error {
+		if string(m.Key) != s.source {
+			return nil
+		}
+		if m.Value == nil {
+			cp = nil
+			return nil
+		}
+		c := &Checkpoint{}
+		if err := json.Unmarshal(m.Value, c); err != nil {
+			return errors.Wrapf(err, "invalid checkpoint at offset %d", m.Offset)
+		}
+		cp = c
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defaultLogger.WithFields(Fields{
+		"source":     s.source,
+		"checkpoint": cp,
+	}).Info("Loaded checkpoint")
+	return cp, nil
+}
+
+func (s *kafkaCheckpointStore) Save(ctx context.Context, cp *Checkpoint) error {
+	msg, err := s.message(cp)
+	if err != nil {
+		return err
+	}
+	return write(ctx, s.producer, []kafka.Message{msg})
+}
+
+// message is how cp is saved, it can be written along with the events it covers.
+func (s *kafkaCheckpointStore) message(cp *Checkpoint) (kafka.Message, error) {
+	cp.Source = s.source
+	value, err := json.Marshal(cp)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+	return kafka.Message{
+		Topic: s.topic,
+		Key:   []byte(s.source),
+		Value: value,
+		Time:  cp.Time,
+	}, nil
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -23,6 +24,9 @@ func main() {
 	var (
 		configdir = flag.String("c", "config", "config directory path")
 		debug     = flag.String("d", "true", "debug mode")
+		metrics   = flag.String("m", ":6060", "metrics and pprof listen address")
+		liveness  = flag.Duration("l", time.Minute, "time without binlog events before failing the liveness check")
+		reload    = flag.Duration("r", 10*time.Second, "how often to check the config directory for changes, 0 only reloads on SIGHUP")
 	)
 	flag.Parse()
 	if strings.ToLower(*debug) == "true" {
@@ -34,17 +38,183 @@ func main() {
 		log.SetLevel(log.InfoLevel)
 		log.SetFormatter(common.LogFormatter{Formatter: new(log.JSONFormatter)})
 	}
+	logger := binlog.NewLogrusLogger(log.StandardLogger())
+	binlog.SetLogger(logger)
+
+	binlog.LivenessThreshold = *liveness
+	binlog.ServeMetrics(*metrics)
 
 	secrets, err := binlog.ParseSecretsFile(*configdir)
 	if err != nil {
 		log.WithError(err).Panic("can't parse secrets file")
 	}
-	eh := binlog.NewKafkaEventHandler(secrets.Kafka.WriteConfiger("test"))
-	eh.AutoEmit(context.Background(), (time.Second))
-	ctx := secrets.Master.OpenCanal(eh)
+	if err := secrets.Validate(binlog.RequireSources | binlog.RequireKafka); err != nil {
+		log.Fatal(err)
+	}
+	setLogLevel(secrets)
+	producer, err := secrets.Kafka.NewProducer()
+	if err != nil {
+		log.WithError(err).Panic("can't create kafka producer")
+	}
+	defer producer.Close()
+	var aggregate binlog.Producer
+	if secrets.Kafka.Aggregate.Enabled {
+		if aggregate, err = secrets.Kafka.NewAggregateProducer(); err != nil {
+			log.WithError(err).Panic("can't create aggregate kafka producer")
+		}
+		defer aggregate.Close()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	shards := &shardHandlers{configure: make(map[string]configureFunc)}
+	for _, shard := range secrets.SourceShards() {
+		shard.Mysql.Logger = logger.WithField("shard", shard.ID)
+		wg.Add(1)
+		go func(shard *binlog.ShardConfig) {
+			defer wg.Done()
+			if !secrets.Zk.Election {
+				streamShard(ctx, secrets, shard, producer, aggregate, shards)
+				return
+			}
+			// standbys take over from the checkpoint once the leader goes away.
+			shard.RunAsLeader(ctx, secrets.NewLeaderLock(shard), func(ctx context.Context) {
+				streamShard(ctx, secrets, shard, producer, aggregate, shards)
+			})
+		}(shard)
+	}
 	log.Info("Canal Open")
 
+	go binlog.WatchSecrets(ctx, *configdir, *reload, func(next *binlog.Secrets) {
+		reloadSecrets(secrets, next, shards)
+	})
+
 	gracefulShutdown(ctx)
+	cancel()
+	wg.Wait()
+}
+
+// configureFunc applies the settings of the secrets that can change while a shard is
+// streamed.
+type configureFunc func(*binlog.Secrets, *binlog.ShardConfig) error
+
+// shardHandlers keeps how to configure the handler of every shard once it is streaming.
+type shardHandlers struct {
+	sync.Mutex
+	configure map[string]configureFunc
+}
+
+func (s *shardHandlers) add(id string, fn configureFunc) {
+	s.Lock()
+	defer s.Unlock()
+	s.configure[id] = fn
+}
+
+func (s *shardHandlers) get(id string) configureFunc {
+	s.Lock()
+	defer s.Unlock()
+	return s.configure[id]
+}
+
+// reloadSecrets applies the changes in next that are safe while streaming and logs the
+// ones that need a restart, which are not applied.
+func reloadSecrets(current, next *binlog.Secrets, shards *shardHandlers) {
+	if err := next.Validate(binlog.RequireSources | binlog.RequireKafka); err != nil {
+		log.WithError(err).Error("Ignoring reloaded secrets")
+		return
+	}
+	if changed := current.RestartRequired(next); len(changed) > 0 {
+		log.WithField("fields", changed).Error("Ignoring changes to the secrets that need a restart")
+	}
+
+	setLogLevel(next)
+	for _, shard := range next.SourceShards() {
+		configure := shards.get(shard.ID)
+		if configure == nil {
+			continue
+		}
+		if err := configure(next, shard); err != nil {
+			log.WithError(err).WithField("shard", shard.ID).Error("Unable to apply reloaded secrets")
+		}
+	}
+	log.Info("Applied reloaded secrets")
+}
+
+func setLogLevel(secrets *binlog.Secrets) {
+	if secrets.LogLevel == "" {
+		return
+	}
+	level, err := log.ParseLevel(secrets.LogLevel)
+	if err != nil {
+		log.WithError(err).Error("invalid log level")
+		return
+	}
+	log.SetLevel(level)
+}
+
+// streamShard sets up the handler of a shard and streams the shard from its checkpoint
+// until ctx is done. Events are mirrored through aggregate unless it is nil.
+func streamShard(ctx context.Context, secrets *binlog.Secrets, shard *binlog.ShardConfig, producer, aggregate binlog.Producer, shards *shardHandlers) {
+	var cp *binlog.Checkpoint
+	if secrets.Kafka.TransactionalID != "" {
+		// every source writes its own transactions, which fences off the producer of a
+		// previous leader.
+		p, err := secrets.Kafka.NewTransactionalProducer(shard.Mysql.SourceID())
+		if err != nil {
+			log.WithError(err).WithField("shard", shard.ID).Panic("can't create transactional kafka producer")
+		}
+		defer p.Close()
+		producer = p
+	}
+	h := binlog.NewKafkaEventHandler(producer, secrets.Kafka.NewEncoder())
+	h.EnableShard(shard.ID)
+	h.SetLogger(shard.Mysql.Logger)
+	if err := h.Configure(&secrets.Kafka, shard); err != nil {
+		log.WithError(err).WithField("shard", shard.ID).Panic("can't configure shard")
+	}
+	if aggregate != nil {
+		if err := h.EnableAggregate(aggregate, &secrets.Kafka.Aggregate); err != nil {
+			log.WithError(err).WithField("shard", shard.ID).Panic("can't mirror to the aggregate cluster")
+		}
+	}
+	if secrets.Heartbeat.Enabled {
+		// every shard stamps its own table.
+		hb := secrets.Heartbeat
+		hw, err := shard.Mysql.NewHeartbeatWriter(&hb)
+		if err != nil {
+			log.WithError(err).WithField("shard", shard.ID).Panic("can't start heartbeat writer")
+		}
+		hw.Run(ctx)
+		h.EnableHeartbeat(&hb)
+	}
+	if secrets.Kafka.Checkpoints {
+		store, err := secrets.Kafka.NewCheckpointStore(ctx, producer, shard.Mysql.SourceID())
+		if err != nil {
+			log.WithError(err).Panic("can't open checkpoint store")
+		}
+		if cp, err = store.Load(ctx); err != nil {
+			log.WithError(err).WithField("shard", shard.ID).Panic("can't load checkpoint")
+		}
+		h.EnableCheckpoints(store)
+		if aggregate != nil {
+			// the aggregate cluster replays what it missed from its own checkpoint.
+			store, err := secrets.Kafka.NewAggregateCheckpointStore(ctx, aggregate, shard.Mysql.SourceID())
+			if err != nil {
+				log.WithError(err).Panic("can't open aggregate checkpoint store")
+			}
+			if err := h.EnableAggregateCheckpoints(ctx, store); err != nil {
+				log.WithError(err).WithField("shard", shard.ID).Panic("can't load aggregate checkpoint")
+			}
+		}
+		cp = h.Resume(cp)
+	}
+	h.AutoEmit(ctx, time.Second)
+	shards.add(shard.ID, func(next *binlog.Secrets, shard *binlog.ShardConfig) error {
+		return h.Configure(&next.Kafka, shard)
+	})
+	if err := shard.Supervise(ctx, h, cp); err != nil {
+		log.WithError(err).WithField("shard", shard.ID).Panic("can't stream shard")
+	}
 }
 
 func gracefulShutdown(ctx context.Context) {
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	_ "net/http/pprof"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Shopify/reportify-query/common"
+	"github.com/highstead/bin-log-poc"
+	kafka "github.com/segmentio/kafka-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// kafka-check compares the change events in a topic with the ground truth log written by
+// mysql-bg-test, and reports events that were lost, duplicated, delivered out of order or
+// carry the wrong values. It exits non-zero if there are any.
+func main() {
+	log.SetFormatter(new(log.JSONFormatter))
+	log.Info("starting kafka-check")
+
+	// Parse flags.
+	var (
+		configdir = flag.String("c", "config", "config directory path")
+		debug     = flag.String("d", "true", "debug mode")
+		metrics   = flag.String("m", ":6060", "metrics and pprof listen address")
+		truth     = flag.String("truth", "truth.jsonl", "ground truth log written by mysql-bg-test")
+		topic     = flag.String("t", "", "change topic, defaults to the one routed for the logged tables")
+	)
+	flag.Parse()
+	if strings.ToLower(*debug) == "true" {
+		log.SetLevel(log.DebugLevel)
+		log.SetOutput(os.Stdout)
+		log.SetFormatter(common.LogFormatter{Formatter: new(log.TextFormatter)})
+		log.Println("Logging in debug mode")
+	} else {
+		log.SetLevel(log.InfoLevel)
+		log.SetFormatter(common.LogFormatter{Formatter: new(log.JSONFormatter)})
+	}
+
+	binlog.ServeMetrics(*metrics)
+
+	secrets, err := binlog.ParseSecretsFile(*configdir)
+	if err != nil {
+		log.WithError(err).Panic("can't parse secrets file")
+	}
+	if err := secrets.Validate(binlog.RequireKafka); err != nil {
+		log.Fatal(err)
+	}
+	records, err := binlog.ReadTruthLog(*truth)
+	if err != nil {
+		log.WithError(err).Fatal("can't read ground truth log")
+	}
+	if len(records) == 0 {
+		log.Fatal("ground truth log is empty")
+	}
+
+	expected := make(map[string][]change)
+	topics := make(map[string]bool)
+	for _, r := range records {
+		k := rowID(r.Schema, r.Table, r.Key)
+		expected[k] = append(expected[k], change{action: r.Action, row: r.Row, seq: r.Seq})
+		if *topic == "" {
+			t, err := secrets.Kafka.NewEncoder().Router.Topic(r.Schema, r.Table)
+			if err != nil {
+				log.WithError(err).Fatal("can't route table to its topic")
+			}
+			topics[t] = true
+		}
+	}
+	if *topic != "" {
+		topics[*topic] = true
+	}
+
+	// events from before the log was started are not part of the run. A binlog timestamp
+	// is when the statement started, truncated to the second, and the first change is
+	// logged once it has committed, so the second before it counts too.
+	start := records[0].Time.Unix() - 1
+	observed := make(map[string][]change)
+	for t := range topics {
+		err := secrets.Kafka.ReadTopic(context.Background(), t, func(m kafka.Message) error {
+			c, k, ok := parseChange(m, expected)
+			if ok && c.ts >= start {
+				observed[k] = append(observed[k], c)
+			}
+			return nil
+		})
+		if err != nil {
+			log.WithError(err).Fatal("can't read change topic")
+		}
+	}
+
+	var r report
+	for k, exp := range expected {
+		r.add(check(k, exp, observed[k]))
+	}
+	entry := log.WithFields(log.Fields{
+		"changes":      len(records),
+		"rows":         len(expected),
+		"lost":         r.lost,
+		"duplicated":   r.duplicated,
+		"out_of_order": r.outOfOrder,
+		"mis_valued":   r.misValued,
+		"unexpected":   r.unexpected,
+	})
+	if r.failed() {
+		entry.Error("change topic does not match the ground truth")
+		os.Exit(1)
+	}
+	entry.Info("change topic matches the ground truth")
+}
+
+type change struct {
+	action string
+	row    map[string]*string
+	// seq is the position of an expected change in the ground truth log.
+	seq int64
+	// ts and offset are where an observed change was read from.
+	ts     int64
+	offset int64
+}
+
+func (c change) String() string {
+	return fmt.Sprintf("%s %s", c.action, formatRow(c.row))
+}
+
+func rowID(schema, table, key string) string {
+	return schema + "." + table + ":" + key
+}
+
+// parseChange returns the change event in m when it is for a row of the ground truth.
+func parseChange(m kafka.Message, expected map[string][]change) (change, string, bool) {
+	if m.Value == nil {
+		return change{}, "", false
+	}
+	ev := &binlog.ChangeEvent{}
+	d := json.NewDecoder(bytes.NewReader(m.Value))
+	d.UseNumber()
+	if err := d.Decode(ev); err != nil || len(ev.PrimaryKey) != 1 {
+		return change{}, "", false
+	}
+	image := ev.After
+	if image == nil {
+		image = ev.Before
+	}
+	key := textValue(image[ev.PrimaryKey[0]])
+	if key == nil {
+		return change{}, "", false
+	}
+	k := rowID(ev.Schema, ev.Table, *key)
+	if _, ok := expected[k]; !ok {
+		return change{}, "", false
+	}
+
+	c := change{action: ev.Action, ts: ev.Source.Timestamp.Unix(), offset: m.Offset}
+	if ev.After != nil {
+		c.row = make(map[string]*string, len(ev.After))
+		for col, v := range ev.After {
+			c.row[col] = textValue(v)
+		}
+	}
+	return c, k, true
+}
+
+// textValue converts a change event's value to the text form mysql uses.
+func textValue(v interface{}) *string {
+	var s string
+	switch value := v.(type) {
+	case nil:
+		return nil
+	case string:
+		s = value
+	case json.Number:
+		s = value.String()
+	case bool:
+		s = "0"
+		if value {
+			s = "1"
+		}
+	default:
+		s = fmt.Sprint(value)
+	}
+	return &s
+}
+
+// same compares the values of two changes. Numbers are compared by value since decimals
+// may be decoded from the binlog as floats.
+func same(a, b change) bool {
+	if a.action != b.action || len(a.row) != len(b.row) {
+		return false
+	}
+	for col, v := range a.row {
+		w, ok := b.row[col]
+		if !ok || (v == nil) != (w == nil) {
+			return false
+		}
+		if v == nil || *v == *w {
+			continue
+		}
+		x, xerr := strconv.ParseFloat(*v, 64)
+		y, yerr := strconv.ParseFloat(*w, 64)
+		if xerr != nil || yerr != nil || x != y {
+			return false
+		}
+	}
+	return true
+}
+
+type report struct {
+	lost       int
+	duplicated int
+	outOfOrder int
+	misValued  int
+	unexpected int
+}
+
+func (r *report) add(o report) {
+	r.lost += o.lost
+	r.duplicated += o.duplicated
+	r.outOfOrder += o.outOfOrder
+	r.misValued += o.misValued
+	r.unexpected += o.unexpected
+}
+
+func (r *report) failed() bool {
+	return r.lost+r.duplicated+r.outOfOrder+r.misValued+r.unexpected > 0
+}
+
+// check matches the changes observed for a row with the ones expected for it in order.
+func check(k string, expected, observed []change) report {
+	var r report
+	matched := make([]bool, len(expected))
+	last := -1
+	for _, o := range observed {
+		entry := log.WithFields(log.Fields{
+			"row":      k,
+			"offset":   o.offset,
+			"observed": o,
+		})
+
+		i := firstUnmatched(expected, matched, func(e change) bool { return same(e, o) })
+		if i >= 0 {
+			if i < last {
+				r.outOfOrder++
+				entry.WithField("expected_seq", expected[i].seq).Warn("change out of order")
+			}
+			matched[i] = true
+			if i > last {
+				last = i
+			}
+			continue
+		}
+
+		if duplicate(expected, matched, o) {
+			r.duplicated++
+			entry.Warn("change duplicated")
+			continue
+		}
+
+		// the next change with the same action is taken to be the one with the wrong values.
+		i = firstUnmatched(expected, matched, func(e change) bool { return e.action == o.action })
+		if i >= 0 {
+			r.misValued++
+			matched[i] = true
+			entry.WithField("expected", expected[i]).Warn("change has the wrong values")
+			continue
+		}
+		r.unexpected++
+		entry.Warn("unexpected change")
+	}
+
+	for i, e := range expected {
+		if !matched[i] {
+			r.lost++
+			log.WithFields(log.Fields{
+				"row":          k,
+				"expected_seq": e.seq,
+				"expected":     e,
+			}).Warn("change lost")
+		}
+	}
+	return r
+}
+
+func firstUnmatched(expected []change, matched []bool, fn func(change) bool) int {
+	for i, e := range expected {
+		if !matched[i] && fn(e) {
+			return i
+		}
+	}
+	return -1
+}
+
+func duplicate(expected []change, matched []bool, o change) bool {
+	for i, e := range expected {
+		if matched[i] && same(e, o) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatRow(row map[string]*string) string {
+	if row == nil {
+		return "()"
+	}
+	b, _ := json.Marshal(row)
+	return string(b)
+}
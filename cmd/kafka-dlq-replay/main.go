@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"flag"
+	_ "net/http/pprof"
+	"os"
+	"strings"
+
+	"github.com/Shopify/reportify-query/common"
+	"github.com/highstead/bin-log-poc"
+	"github.com/pkg/errors"
+	kafka "github.com/segmentio/kafka-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// kafka-dlq-replay converts the row changes in the dead letter topic again and writes the
+// ones that now succeed to their topics. Every run carries on from where the last one
+// stopped and it exits non-zero if any of them still fail.
+func main() {
+	log.SetFormatter(new(log.JSONFormatter))
+	log.Info("starting kafka-dlq-replay")
+
+	// Parse flags.
+	var (
+		configdir = flag.String("c", "config", "config directory path")
+		debug     = flag.String("d", "true", "debug mode")
+		metrics   = flag.String("m", ":6060", "metrics and pprof listen address")
+		topic     = flag.String("t", "", "dead letter topic, defaults to the configured one")
+		dryRun    = flag.Bool("n", false, "convert the dead letters without writing them")
+		refresh   = flag.Bool("s", true, "convert with the current table schemas read from the sources")
+	)
+	flag.Parse()
+	if strings.ToLower(*debug) == "true" {
+		log.SetLevel(log.DebugLevel)
+		log.SetOutput(os.Stdout)
+		log.SetFormatter(common.LogFormatter{Formatter: new(log.TextFormatter)})
+		log.Println("Logging in debug mode")
+	} else {
+		log.SetLevel(log.InfoLevel)
+		log.SetFormatter(common.LogFormatter{Formatter: new(log.JSONFormatter)})
+	}
+
+	binlog.ServeMetrics(*metrics)
+
+	secrets, err := binlog.ParseSecretsFile(*configdir)
+	if err != nil {
+		log.WithError(err).Panic("can't parse secrets file")
+	}
+	need := binlog.RequireKafka
+	if *refresh {
+		need |= binlog.RequireSources
+	}
+	if err := secrets.Validate(need); err != nil {
+		log.Fatal(err)
+	}
+	if *topic == "" {
+		*topic = secrets.Kafka.DeadLetterTopic
+	}
+	if *topic == "" {
+		log.Fatal("no dead letter topic configured")
+	}
+
+	producer, err := secrets.Kafka.NewProducer()
+	if err != nil {
+		log.WithError(err).Panic("can't create kafka producer")
+	}
+	defer producer.Close()
+
+	var schemas *schemaCache
+	if *refresh {
+		schemas = newSchemaCache(secrets)
+		defer schemas.Close()
+	}
+
+	replayed, failed, err := replay(context.Background(), secrets, producer, schemas, *topic, *dryRun)
+	entry := log.WithFields(log.Fields{
+		"replayed": replayed,
+		"failed":   failed,
+		"dry_run":  *dryRun,
+	})
+	if err != nil {
+		entry.WithError(err).Fatal("unable to replay dead letters")
+	}
+	if failed > 0 {
+		entry.Error("some dead letters are still failing")
+		os.Exit(1)
+	}
+	entry.Info("replayed dead letters")
+}
+
+// replay converts the dead letters of every partition from where the last run stopped.
+// The ones that still fail are written to the end of the topic again, so that the next run
+// retries them without converting the ones in between a second time.
+func replay(ctx context.Context, secrets *binlog.Secrets, producer binlog.Producer, schemas *schemaCache, topic string, dryRun bool) (replayed, failed int, err error) {
+	encoder := secrets.Kafka.NewEncoder()
+	progress, err := secrets.Kafka.LoadConsumerProgress(ctx, producer, "kafka-dlq-replay."+topic)
+	if err != nil {
+		return 0, 0, err
+	}
+	partitions, err := secrets.Kafka.Partitions(ctx, topic)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, p := range partitions {
+		err = secrets.Kafka.ReadPartition(ctx, topic, p.ID, progress.Offset(p.ID), func(m kafka.Message) error {
+			entry := log.WithFields(log.Fields{
+				"partition": m.Partition,
+				"offset":    m.Offset,
+			})
+			msgs, err := convert(m, encoder, schemas, topic)
+			if _, ok := err.(fatal); ok {
+				return err
+			}
+			if err != nil {
+				entry.WithError(err).Warn("dead letter still failing")
+				failed++
+			} else {
+				replayed++
+			}
+			if dryRun {
+				return nil
+			}
+			if len(msgs) > 0 {
+				if err := producer.WriteMessages(ctx, msgs...); err != nil {
+					return err
+				}
+			}
+			return progress.Save(ctx, m.Partition, m.Offset+1)
+		})
+		if err != nil {
+			return replayed, failed, err
+		}
+	}
+	return replayed, failed, nil
+}
+
+// convert returns the messages of a dead letter that converts now, or the dead letter
+// with the new error to write to topic again along with that error.
+func convert(m kafka.Message, encoder *binlog.Encoder, schemas *schemaCache, topic string) ([]kafka.Message, error) {
+	dl, err := binlog.ParseDeadLetter(m.Value)
+	if err != nil {
+		// it can never be replayed, so it isn't retried either.
+		return nil, errors.Wrap(err, "unable to parse dead letter")
+	}
+	if schemas != nil {
+		t, err := schemas.table(dl.Source.Shard, dl.Table.Schema, dl.Table.Name)
+		if err != nil {
+			// the dead letter is left for the next run.
+			return nil, fatal{err}
+		}
+		if t != nil {
+			dl.Refresh(t)
+		}
+	}
+	msgs, cause := dl.Replay(encoder)
+	if cause == nil {
+		return msgs, nil
+	}
+	dl.Error = cause.Error()
+	msg, err := dl.Message(topic)
+	if err != nil {
+		return nil, fatal{err}
+	}
+	return []kafka.Message{msg}, cause
+}
+
+// fatal stops the replay before the dead letter it occurred on.
+type fatal struct {
+	error
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"database/sql"
+
+	"github.com/highstead/bin-log-poc"
+	"github.com/pkg/errors"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+// schemaCache reads the current schema of the tables dead letters were recorded for from
+// the shard they came from, connecting to every shard once.
+type schemaCache struct {
+	shards map[string]*binlog.ShardConfig
+	dbs    map[string]*sql.DB
+	tables map[string]*schema.Table
+}
+
+func newSchemaCache(secrets *binlog.Secrets) *schemaCache {
+	c := &schemaCache{
+		shards: make(map[string]*binlog.ShardConfig),
+		dbs:    make(map[string]*sql.DB),
+		tables: make(map[string]*schema.Table),
+	}
+	for _, shard := range secrets.SourceShards() {
+		c.shards[shard.ID] = shard
+	}
+	return c
+}
+
+// table returns nil when the table doesn't exist anymore.
+func (c *schemaCache) table(shard, db, name string) (*schema.Table, error) {
+	key := shard + "/" + db + "." + name
+	if t, ok := c.tables[key]; ok {
+		return t, nil
+	}
+
+	conn, ok := c.dbs[shard]
+	if !ok {
+		sh, ok := c.shards[shard]
+		if !ok {
+			return nil, errors.Errorf("shard %q is not configured", shard)
+		}
+		var err error
+		if conn, err = sh.Mysql.Connect(); err != nil {
+			return nil, err
+		}
+		c.dbs[shard] = conn
+	}
+
+	var exists bool
+	err := conn.QueryRow(`SELECT COUNT(*) > 0 FROM information_schema.tables WHERE table_schema = ? AND table_name = ?`, db, name).Scan(&exists)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot look up %s.%s", db, name)
+	}
+	var t *schema.Table
+	if exists {
+		if t, err = schema.NewTableFromSqlDB(conn, db, name); err != nil {
+			return nil, errors.Wrapf(err, "cannot read schema of %s.%s", db, name)
+		}
+	}
+	c.tables[key] = t
+	return t, nil
+}
+
+func (c *schemaCache) Close() {
+	for _, db := range c.dbs {
+		db.Close()
+	}
+}
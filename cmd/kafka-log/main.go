@@ -23,6 +23,7 @@ func main() {
 	var (
 		configdir = flag.String("c", "config", "config directory path")
 		debug     = flag.String("d", "true", "debug mode")
+		metrics   = flag.String("m", ":6060", "metrics and pprof listen address")
 	)
 	flag.Parse()
 	if strings.ToLower(*debug) == "true" {
@@ -35,10 +36,15 @@ func main() {
 		log.SetFormatter(common.LogFormatter{Formatter: new(log.JSONFormatter)})
 	}
 
+	binlog.ServeMetrics(*metrics)
+
 	secrets, err := binlog.ParseSecretsFile(*configdir)
 	if err != nil {
 		log.WithError(err).Panic("can't parse secrets file")
 	}
+	if err := secrets.Validate(binlog.RequireKafka); err != nil {
+		log.Fatal(err)
+	}
 	ctx := context.Background()
 	kafkaToLog(ctx, secrets, "test")
 
@@ -58,18 +64,11 @@ func gracefulShutdown(ctx context.Context) {
 }
 
 func kafkaToLog(ctx context.Context, secrets *binlog.Secrets, topic string) {
-	rcfg := *secrets.Kafka.ReadConfiger(topic, 0)
-	r := kafka.NewReader(rcfg)
-	defer r.Close()
-	//r.SetOffset(kafka.LastOffset)
-	r.SetOffset(kafka.FirstOffset)
-
-	for {
-		m, err := r.ReadMessage(context.Background())
-		if err != nil {
-			log.WithError(err).Println("unable to read kafka message")
-			break
-		}
+	err := secrets.Kafka.FollowPartition(context.Background(), topic, 0, kafka.FirstOffset, func(m kafka.Message) error {
 		log.WithField("msg", m.Value).Printf("off:%v, key: %v ", m.Offset, m.Key)
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Println("unable to read kafka message")
 	}
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"flag"
+	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/Shopify/reportify-query/common"
+	"github.com/highstead/bin-log-poc"
+	_ "github.com/mattn/go-sqlite3"
+	kafka "github.com/segmentio/kafka-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// kafka-materialize follows change event topics and keeps a local sqlite copy of the
+// tables they describe.
+func main() {
+	log.SetFormatter(new(log.JSONFormatter))
+	log.Info("starting kafka-materialize")
+
+	// Parse flags.
+	var (
+		configdir = flag.String("c", "config", "config directory path")
+		debug     = flag.String("d", "true", "debug mode")
+		metrics   = flag.String("m", ":6060", "metrics and pprof listen address")
+		dbPath    = flag.String("db", "materialized.db", "sqlite database path")
+		topics    = flag.String("t", "", "comma separated change event topics, defaults to the configured topic")
+	)
+	flag.Parse()
+	if strings.ToLower(*debug) == "true" {
+		log.SetLevel(log.DebugLevel)
+		log.SetOutput(os.Stdout)
+		log.SetFormatter(common.LogFormatter{Formatter: new(log.TextFormatter)})
+		log.Println("Logging in debug mode")
+	} else {
+		log.SetLevel(log.InfoLevel)
+		log.SetFormatter(common.LogFormatter{Formatter: new(log.JSONFormatter)})
+	}
+
+	binlog.ServeMetrics(*metrics)
+
+	secrets, err := binlog.ParseSecretsFile(*configdir)
+	if err != nil {
+		log.WithError(err).Panic("can't parse secrets file")
+	}
+	if err := secrets.Validate(binlog.RequireKafka); err != nil {
+		log.Fatal(err)
+	}
+	if *topics == "" {
+		*topics = secrets.Kafka.Topic
+	}
+	if *topics == "" || strings.Contains(*topics, "{") {
+		log.Fatal("topics must be given when the configured topic is a template")
+	}
+
+	m, err := openMirror(*dbPath)
+	if err != nil {
+		log.WithError(err).Panic("can't open sqlite database")
+	}
+	defer m.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := materialize(ctx, secrets, m, strings.Split(*topics, ","))
+	gracefulShutdown(done)
+	cancel()
+}
+
+func gracefulShutdown(done <-chan struct{}) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case <-stop:
+		log.Info("Recieved stop signal")
+	case <-done:
+		log.Info("Stopped materializing")
+	}
+}
+
+// materialize follows every partition of the topics until ctx is done or one of them
+// fails. The returned channel is closed once they have all stopped.
+func materialize(ctx context.Context, secrets *binlog.Secrets, m *mirror, topics []string) <-chan struct{} {
+	ctx, cancel := context.WithCancel(ctx)
+	wg := new(sync.WaitGroup)
+	// every partition shares the mirror, whose table cache isn't safe for concurrent use.
+	applying := new(sync.Mutex)
+
+	for _, topic := range topics {
+		partitions, err := secrets.Kafka.Partitions(ctx, topic)
+		if err != nil {
+			log.WithError(err).Panic("can't look up partitions")
+		}
+		for _, p := range partitions {
+			wg.Add(1)
+			go func(topic string, partition int) {
+				defer wg.Done()
+				defer cancel()
+				err := follow(ctx, secrets, m, applying, topic, partition)
+				if err != nil && ctx.Err() == nil {
+					log.WithError(err).WithField("topic", topic).Error("stopped following partition")
+				}
+			}(topic, p.ID)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		cancel()
+		close(done)
+	}()
+	return done
+}
+
+func follow(ctx context.Context, secrets *binlog.Secrets, m *mirror, applying *sync.Mutex, topic string, partition int) error {
+	offset, err := m.offset(topic, partition)
+	if err != nil {
+		return err
+	}
+	start := int64(kafka.FirstOffset)
+	if offset >= 0 {
+		start = offset + 1
+	}
+
+	log.WithFields(log.Fields{
+		"topic":     topic,
+		"partition": partition,
+		"offset":    start,
+	}).Info("Following partition")
+
+	return secrets.Kafka.FollowPartition(ctx, topic, partition, start, func(msg kafka.Message) error {
+		applying.Lock()
+		defer applying.Unlock()
+		return m.apply(msg)
+	})
+}
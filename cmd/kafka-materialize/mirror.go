@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/highstead/bin-log-poc"
+	"github.com/pkg/errors"
+	kafka "github.com/segmentio/kafka-go"
+	"github.com/siddontang/go-mysql/canal"
+	log "github.com/sirupsen/logrus"
+)
+
+// mirror applies change events to a sqlite database. Each message is applied in its own
+// transaction along with the offset it was read from, so the mirror always resumes from
+// exactly where it left off.
+type mirror struct {
+	db *sql.DB
+	// columns caches the columns of every mirrored table.
+	columns map[string]map[string]bool
+}
+
+func openMirror(path string) (*mirror, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=5000", path))
+	if err != nil {
+		return nil, err
+	}
+	// sqlite only allows one writer at a time.
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS _kafka_offsets (
+		topic TEXT NOT NULL,
+		partition INTEGER NOT NULL,
+		offset INTEGER NOT NULL,
+		PRIMARY KEY (topic, partition)
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "cannot create offsets table")
+	}
+	return &mirror{
+		db:      db,
+		columns: make(map[string]map[string]bool),
+	}, nil
+}
+
+func (m *mirror) Close() error {
+	return m.db.Close()
+}
+
+// offset returns the last offset applied from a partition or -1 if there is none.
+func (m *mirror) offset(topic string, partition int) (int64, error) {
+	var offset int64
+	err := m.db.QueryRow(`SELECT offset FROM _kafka_offsets WHERE topic = ? AND partition = ?`, topic, partition).Scan(&offset)
+	if err == sql.ErrNoRows {
+		return -1, nil
+	}
+	return offset, err
+}
+
+func (m *mirror) apply(msg kafka.Message) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+			// tables and columns cached while applying are gone with the transaction.
+			m.columns = make(map[string]map[string]bool)
+		}
+	}()
+
+	if err := m.applyMessage(tx, msg); err != nil {
+		return errors.Wrapf(err, "cannot apply %s/%d@%d", msg.Topic, msg.Partition, msg.Offset)
+	}
+
+	_, err = tx.Exec(`INSERT OR REPLACE INTO _kafka_offsets (topic, partition, offset) VALUES (?, ?, ?)`,
+		msg.Topic, msg.Partition, msg.Offset)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+func (m *mirror) applyMessage(tx *sql.Tx, msg kafka.Message) error {
+	if msg.Value == nil {
+		key, err := binlog.ParseRowKey(msg.Key)
+		if err != nil {
+			log.WithError(err).WithField("offset", msg.Offset).Warn("skipping tombstone with unknown key")
+			return nil
+		}
+		return m.delete(tx, tableName(key.Schema, key.Table), key.Key)
+	}
+
+	ev := &binlog.ChangeEvent{}
+	d := json.NewDecoder(bytes.NewReader(msg.Value))
+	d.UseNumber()
+	if err := d.Decode(ev); err != nil || ev.Action == "" {
+		log.WithError(err).WithField("offset", msg.Offset).Warn("skipping message that is not a change event")
+		return nil
+	}
+	if len(ev.PrimaryKey) == 0 {
+		log.WithField("table", ev.Table).Debug("skipping change to table without a primary key")
+		return nil
+	}
+
+	table := tableName(ev.Schema, ev.Table)
+	image := ev.After
+	if ev.Action == canal.DeleteAction {
+		image = ev.Before
+	}
+	if err := m.ensureTable(tx, table, ev.PrimaryKey, image); err != nil {
+		return err
+	}
+
+	switch ev.Action {
+	case canal.DeleteAction:
+		return m.delete(tx, table, keyOf(ev.PrimaryKey, ev.Before))
+	case canal.UpdateAction:
+		// the primary key may have changed, the old row has to go.
+		if err := m.delete(tx, table, keyOf(ev.PrimaryKey, ev.Before)); err != nil {
+			return err
+		}
+		return m.upsert(tx, table, ev.After)
+	default:
+		return m.upsert(tx, table, ev.After)
+	}
+}
+
+func (m *mirror) upsert(tx *sql.Tx, table string, row map[string]interface{}) error {
+	cols := sortedColumns(row)
+	names := make([]string, len(cols))
+	args := make([]interface{}, len(cols))
+	for i, c := range cols {
+		names[i] = quote(c)
+		args[i] = sqliteValue(row[c])
+	}
+	query := fmt.Sprintf("INSERT OR REPLACE INTO %s (%s) VALUES (%s)",
+		quote(table), strings.Join(names, ", "), strings.TrimSuffix(strings.Repeat("?, ", len(cols)), ", "))
+	_, err := tx.Exec(query, args...)
+	return err
+}
+
+func (m *mirror) delete(tx *sql.Tx, table string, key map[string]interface{}) error {
+	if len(key) == 0 || !m.hasTable(tx, table) {
+		return nil
+	}
+	cols := sortedColumns(key)
+	where := make([]string, len(cols))
+	args := make([]interface{}, len(cols))
+	for i, c := range cols {
+		where[i] = quote(c) + " = ?"
+		args[i] = sqliteValue(key[c])
+	}
+	_, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s", quote(table), strings.Join(where, " AND ")), args...)
+	return err
+}
+
+func (m *mirror) hasTable(tx *sql.Tx, table string) bool {
+	if _, ok := m.columns[table]; ok {
+		return true
+	}
+	return m.loadColumns(tx, table) == nil && len(m.columns[table]) > 0
+}
+
+func (m *mirror) loadColumns(tx *sql.Tx, table string) error {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", quote(table)))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	cols := make(map[string]bool)
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name             string
+			ctype            string
+			dflt             sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &ctype, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		cols[name] = true
+	}
+	if len(cols) > 0 {
+		m.columns[table] = cols
+	}
+	return rows.Err()
+}
+
+// ensureTable creates the table from the columns of the change event, or adds the
+// columns the table doesn't have yet. Columns are untyped since sqlite stores each value
+// with its own type.
+func (m *mirror) ensureTable(tx *sql.Tx, table string, pk []string, row map[string]interface{}) error {
+	if !m.hasTable(tx, table) {
+		cols := sortedColumns(row)
+		defs := make([]string, len(cols))
+		for i, c := range cols {
+			defs[i] = quote(c)
+		}
+		keys := make([]string, len(pk))
+		for i, c := range pk {
+			keys[i] = quote(c)
+		}
+		query := fmt.Sprintf("CREATE TABLE %s (%s, PRIMARY KEY (%s))", quote(table), strings.Join(defs, ", "), strings.Join(keys, ", "))
+		if _, err := tx.Exec(query); err != nil {
+			return errors.Wrapf(err, "cannot create %s", table)
+		}
+		log.WithField("table", table).Info("Created mirrored table")
+		m.columns[table] = make(map[string]bool)
+		for _, c := range cols {
+			m.columns[table][c] = true
+		}
+		return nil
+	}
+
+	for _, c := range sortedColumns(row) {
+		if m.columns[table][c] {
+			continue
+		}
+		if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", quote(table), quote(c))); err != nil {
+			return errors.Wrapf(err, "cannot add %s to %s", c, table)
+		}
+		log.WithFields(log.Fields{
+			"table":  table,
+			"column": c,
+		}).Info("Added mirrored column")
+		m.columns[table][c] = true
+	}
+	return nil
+}
+
+func tableName(schema, table string) string {
+	return schema + "." + table
+}
+
+func quote(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+func keyOf(pk []string, row map[string]interface{}) map[string]interface{} {
+	if row == nil {
+		return nil
+	}
+	key := make(map[string]interface{}, len(pk))
+	for _, c := range pk {
+		key[c] = row[c]
+	}
+	return key
+}
+
+func sortedColumns(row map[string]interface{}) []string {
+	cols := make([]string, 0, len(row))
+	for c := range row {
+		cols = append(cols, c)
+	}
+	sort.Strings(cols)
+	return cols
+}
+
+func sqliteValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case nil, string, bool:
+		return value
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i
+		}
+		if f, err := value.Float64(); err == nil {
+			return f
+		}
+		return value.String()
+	default:
+		b, _ := json.Marshal(value)
+		return string(b)
+	}
+}
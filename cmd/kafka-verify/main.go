@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"flag"
+	_ "net/http/pprof"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Shopify/reportify-query/common"
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/highstead/bin-log-poc"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// kafka-verify compares a table in mysql with the rows rebuilt from its change topic. The
+// table is read in chunks of keys whose checksums are computed by mysql, and the rows of
+// chunks that don't match are compared one by one. It exits non-zero on any drift.
+func main() {
+	log.SetFormatter(new(log.JSONFormatter))
+	log.Info("starting kafka-verify")
+
+	// Parse flags.
+	var (
+		configdir = flag.String("c", "config", "config directory path")
+		debug     = flag.String("d", "true", "debug mode")
+		metrics   = flag.String("m", ":6060", "metrics and pprof listen address")
+		table     = flag.String("table", "", "schema.table to verify")
+		topic     = flag.String("t", "", "change topic of the table, defaults to the routed one")
+		from      = flag.Int64("from", 0, "first key to verify, defaults to the smallest key")
+		to        = flag.Int64("to", 0, "last key to verify, defaults to the largest key")
+		chunk     = flag.Int64("chunk", 1000, "keys per checksum chunk")
+		wait      = flag.Duration("w", 5*time.Minute, "how long to wait for the stream to catch up")
+	)
+	flag.Parse()
+	if strings.ToLower(*debug) == "true" {
+		log.SetLevel(log.DebugLevel)
+		log.SetOutput(os.Stdout)
+		log.SetFormatter(common.LogFormatter{Formatter: new(log.TextFormatter)})
+		log.Println("Logging in debug mode")
+	} else {
+		log.SetLevel(log.InfoLevel)
+		log.SetFormatter(common.LogFormatter{Formatter: new(log.JSONFormatter)})
+	}
+	binlog.SetLogger(binlog.NewLogrusLogger(log.StandardLogger()))
+
+	binlog.ServeMetrics(*metrics)
+
+	secrets, err := binlog.ParseSecretsFile(*configdir)
+	if err != nil {
+		log.WithError(err).Panic("can't parse secrets file")
+	}
+	if err := secrets.Validate(binlog.RequireMysql | binlog.RequireKafka); err != nil {
+		log.Fatal(err)
+	}
+	parts := strings.SplitN(*table, ".", 2)
+	if len(parts) != 2 {
+		log.Fatal("table must be given as schema.table")
+	}
+	if *chunk < 1 {
+		log.Fatal("chunk must be positive")
+	}
+	if *topic == "" {
+		*topic, err = secrets.Kafka.NewEncoder().Router.Topic(parts[0], parts[1])
+		if err != nil {
+			log.WithError(err).Fatal("can't route table to its topic")
+		}
+	}
+
+	db, err := secrets.Master.Connect()
+	if err != nil {
+		log.WithError(err).Panic("can't connect to mysql")
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	s, err := openSnapshot(ctx, db, parts[0], parts[1])
+	if err != nil {
+		log.WithError(err).Fatal("can't snapshot table")
+	}
+	defer s.Close()
+
+	if err := waitForStream(ctx, secrets, s, *wait); err != nil {
+		log.WithError(err).Fatal("stream did not catch up")
+	}
+
+	lo, hi, err := s.keyRange(ctx)
+	if err != nil {
+		log.WithError(err).Fatal("can't read key range")
+	}
+	if *from == 0 {
+		*from = lo
+	}
+	if *to == 0 {
+		*to = hi
+	}
+
+	stream, err := rebuild(ctx, secrets, s, *topic, *from, *to)
+	if err != nil {
+		log.WithError(err).Fatal("can't rebuild table from stream")
+	}
+
+	r, err := verify(ctx, s, stream, *from, *to, *chunk)
+	entry := log.WithFields(log.Fields{
+		"table":      *table,
+		"position":   s.position,
+		"chunks":     r.chunks,
+		"drifted":    r.drifted,
+		"missing":    r.missing,
+		"extra":      r.extra,
+		"differing":  r.differing,
+		"stream_len": len(stream),
+	})
+	if err != nil {
+		entry.WithError(err).Fatal("unable to verify table")
+	}
+	if r.drifted > 0 {
+		entry.Error("stream has drifted from mysql")
+		s.Close()
+		os.Exit(1)
+	}
+	entry.Info("stream matches mysql")
+}
+
+// waitForStream waits until the pipeline has checkpointed the snapshot's position, so that
+// every change up to it is in the topic.
+func waitForStream(ctx context.Context, secrets *binlog.Secrets, s *snapshot, wait time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	// the store is only loaded from so it needs no producer.
+	store, err := secrets.Kafka.NewCheckpointStore(ctx, nil, secrets.Master.SourceID())
+	if err != nil {
+		return err
+	}
+	for {
+		cp, err := store.Load(ctx)
+		if err != nil {
+			return err
+		}
+		if cp != nil && cp.Position.Compare(s.position) >= 0 {
+			return nil
+		}
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+			return errors.Errorf("no checkpoint at or past %s", s.position)
+		}
+	}
+}
+
+type report struct {
+	chunks    int
+	drifted   int
+	missing   int
+	extra     int
+	differing int
+}
+
+func verify(ctx context.Context, s *snapshot, stream map[int64]row, from, to, chunk int64) (report, error) {
+	var r report
+	keys := make([]int64, 0, len(stream))
+	for key := range stream {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	for lo := from; lo <= to; lo += chunk {
+		hi := lo + chunk - 1
+		if hi > to || hi < lo {
+			hi = to
+		}
+		r.chunks++
+
+		count, sum, err := s.chunkChecksum(ctx, lo, hi)
+		if err != nil {
+			return r, errors.Wrapf(err, "cannot checksum [%d, %d]", lo, hi)
+		}
+		// the stream's keys of the chunk.
+		first := sort.Search(len(keys), func(i int) bool { return keys[i] >= lo })
+		last := sort.Search(len(keys), func(i int) bool { return keys[i] > hi })
+		chunkKeys := keys[first:last]
+		streamSum := uint32(0)
+		for _, key := range chunkKeys {
+			streamSum ^= stream[key].checksum()
+		}
+		if count == len(chunkKeys) && sum == streamSum {
+			continue
+		}
+
+		r.drifted++
+		rows, err := s.chunkRows(ctx, lo, hi)
+		if err != nil {
+			return r, errors.Wrapf(err, "cannot read [%d, %d]", lo, hi)
+		}
+		for key, row := range rows {
+			entry := log.WithFields(log.Fields{"key": key, "mysql": row})
+			streamRow, ok := stream[key]
+			if !ok {
+				r.missing++
+				entry.Warn("row missing from stream")
+			} else if !row.equal(streamRow) {
+				r.differing++
+				entry.WithField("stream", streamRow).Warn("row differs in stream")
+			}
+		}
+		for _, key := range chunkKeys {
+			if _, ok := rows[key]; !ok {
+				r.extra++
+				log.WithFields(log.Fields{"key": key, "stream": stream[key]}).Warn("row missing from mysql")
+			}
+		}
+	}
+	return r, nil
+}
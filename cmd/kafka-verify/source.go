@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+// row is the text form of a row's values in column order, nil values are NULL.
+type row []*string
+
+// checksum matches the checksum computed by chunkChecksum in mysql for a single row.
+func (r row) checksum() uint32 {
+	parts := make([]string, 0, 2*len(r))
+	for _, v := range r {
+		// CONCAT_WS skips NULLs, ISNULL tells them apart from empty strings.
+		if v == nil {
+			parts = append(parts, "1")
+		} else {
+			parts = append(parts, *v, "0")
+		}
+	}
+	return crc32.ChecksumIEEE([]byte(strings.Join(parts, "#")))
+}
+
+func (r row) equal(o row) bool {
+	if len(r) != len(o) {
+		return false
+	}
+	for i := range r {
+		if (r[i] == nil) != (o[i] == nil) || (r[i] != nil && *r[i] != *o[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r row) String() string {
+	parts := make([]string, len(r))
+	for i, v := range r {
+		if v == nil {
+			parts[i] = "NULL"
+		} else {
+			parts[i] = strconv.Quote(*v)
+		}
+	}
+	return "(" + strings.Join(parts, ", ") + ")"
+}
+
+// snapshot is a consistent read of a table along with the binlog position it was taken at.
+type snapshot struct {
+	conn    *sql.Conn
+	schema  string
+	table   string
+	columns []string
+	// decimals are the columns with a fractional part, the stream drops their trailing
+	// zeros.
+	decimals map[string]bool
+	key      string
+	position mysql.Position
+}
+
+// openSnapshot briefly takes a global read lock so that the snapshot and the binlog
+// position it is taken at match exactly.
+func openSnapshot(ctx context.Context, db *sql.DB, schema, table string) (*snapshot, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s := &snapshot{conn: conn, schema: schema, table: table, decimals: make(map[string]bool)}
+	if err := s.describe(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	statements := []string{
+		// the pipeline writes timestamps in UTC.
+		"SET SESSION time_zone = '+00:00'",
+		"SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ",
+		"FLUSH TABLES WITH READ LOCK",
+		"START TRANSACTION WITH CONSISTENT SNAPSHOT",
+	}
+	for _, stmt := range statements {
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			conn.Close()
+			return nil, errors.Wrapf(err, "cannot %s", strings.ToLower(stmt))
+		}
+	}
+	err = s.masterPosition(ctx)
+	if _, uerr := conn.ExecContext(ctx, "UNLOCK TABLES"); uerr != nil && err == nil {
+		err = uerr
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *snapshot) Close() error {
+	s.conn.ExecContext(context.Background(), "ROLLBACK")
+	return s.conn.Close()
+}
+
+func (s *snapshot) describe(ctx context.Context) error {
+	rows, err := s.conn.QueryContext(ctx, `SELECT COLUMN_NAME, DATA_TYPE, COALESCE(NUMERIC_SCALE, 0) FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION`, s.schema, s.table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			c, dataType string
+			scale       int
+		)
+		if err := rows.Scan(&c, &dataType, &scale); err != nil {
+			return err
+		}
+		s.columns = append(s.columns, c)
+		if strings.EqualFold(dataType, "decimal") && scale > 0 {
+			s.decimals[c] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(s.columns) == 0 {
+		return errors.Errorf("table %s.%s does not exist", s.schema, s.table)
+	}
+
+	var keys []string
+	rows, err = s.conn.QueryContext(ctx, `SELECT COLUMN_NAME FROM information_schema.KEY_COLUMN_USAGE
+		WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND CONSTRAINT_NAME = 'PRIMARY'`, s.schema, s.table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c string
+		if err := rows.Scan(&c); err != nil {
+			return err
+		}
+		keys = append(keys, c)
+	}
+	if len(keys) != 1 {
+		return errors.Errorf("%s.%s needs a single column primary key to be chunked, it has %d", s.schema, s.table, len(keys))
+	}
+	s.key = keys[0]
+	return rows.Err()
+}
+
+func (s *snapshot) masterPosition(ctx context.Context) error {
+	rows, err := s.conn.QueryContext(ctx, "SHOW MASTER STATUS")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	if !rows.Next() {
+		return errors.New("binary logging is not enabled")
+	}
+	values := make([]interface{}, len(cols))
+	for i := range values {
+		values[i] = new(sql.NullString)
+	}
+	if err := rows.Scan(values...); err != nil {
+		return err
+	}
+	pos, err := strconv.ParseUint(values[1].(*sql.NullString).String, 10, 32)
+	if err != nil {
+		return errors.Wrap(err, "invalid master position")
+	}
+	s.position = mysql.Position{Name: values[0].(*sql.NullString).String, Pos: uint32(pos)}
+	return rows.Err()
+}
+
+// keyRange returns the smallest and largest keys of the table.
+func (s *snapshot) keyRange(ctx context.Context) (min, max int64, err error) {
+	var lo, hi sql.NullInt64
+	query := fmt.Sprintf("SELECT MIN(%s), MAX(%s) FROM %s", quote(s.key), quote(s.key), s.name())
+	err = s.conn.QueryRowContext(ctx, query).Scan(&lo, &hi)
+	return lo.Int64, hi.Int64, err
+}
+
+// chunkChecksum returns the number of rows with keys in [from, to] and the XOR of their
+// checksums.
+func (s *snapshot) chunkChecksum(ctx context.Context, from, to int64) (count int, sum uint32, err error) {
+	parts := make([]string, len(s.columns))
+	for i, c := range s.columns {
+		parts[i] = fmt.Sprintf("%s, ISNULL(%s)", s.value(c), quote(c))
+	}
+	query := fmt.Sprintf("SELECT COUNT(*), COALESCE(BIT_XOR(CRC32(CONCAT_WS('#', %s))), 0) FROM %s WHERE %s BETWEEN ? AND ?",
+		strings.Join(parts, ", "), s.name(), quote(s.key))
+	var sum64 uint64
+	err = s.conn.QueryRowContext(ctx, query, from, to).Scan(&count, &sum64)
+	return count, uint32(sum64), err
+}
+
+// chunkRows reads the rows with keys in [from, to].
+func (s *snapshot) chunkRows(ctx context.Context, from, to int64) (map[int64]row, error) {
+	cols := make([]string, len(s.columns))
+	keyIndex := 0
+	for i, c := range s.columns {
+		cols[i] = s.value(c)
+		if c == s.key {
+			keyIndex = i
+		}
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s BETWEEN ? AND ?", strings.Join(cols, ", "), s.name(), quote(s.key))
+	rows, err := s.conn.QueryContext(ctx, query, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[int64]row)
+	for rows.Next() {
+		raw := make([]sql.RawBytes, len(cols))
+		dest := make([]interface{}, len(cols))
+		for i := range raw {
+			dest[i] = &raw[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		r := make(row, len(cols))
+		for i, b := range raw {
+			if b != nil {
+				v := string(b)
+				r[i] = &v
+			}
+		}
+		key, err := strconv.ParseInt(*r[keyIndex], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "non integer key %s", *r[keyIndex])
+		}
+		result[key] = r
+	}
+	return result, rows.Err()
+}
+
+// value selects a column in the text form of the stream's values.
+func (s *snapshot) value(column string) string {
+	if s.decimals[column] {
+		return fmt.Sprintf("TRIM(TRAILING '.' FROM TRIM(TRAILING '0' FROM %s))", quote(column))
+	}
+	return quote(column)
+}
+
+func (s *snapshot) name() string {
+	return quote(s.schema) + "." + quote(s.table)
+}
+
+func quote(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/highstead/bin-log-poc"
+	"github.com/pkg/errors"
+	kafka "github.com/segmentio/kafka-go"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	log "github.com/sirupsen/logrus"
+)
+
+// rebuild replays the change events of the table up to and including the snapshot's
+// position and returns the rows with keys in [from, to].
+func rebuild(ctx context.Context, secrets *binlog.Secrets, s *snapshot, topic string, from, to int64) (map[int64]row, error) {
+	rows := make(map[int64]row)
+	err := secrets.Kafka.ReadTopic(ctx, topic, func(m kafka.Message) error {
+		if m.Value == nil {
+			return nil
+		}
+		ev := &binlog.ChangeEvent{}
+		d := json.NewDecoder(bytes.NewReader(m.Value))
+		d.UseNumber()
+		if err := d.Decode(ev); err != nil {
+			log.WithError(err).WithField("offset", m.Offset).Warn("skipping message that is not a change event")
+			return nil
+		}
+		if ev.Schema != s.schema || ev.Table != s.table {
+			return nil
+		}
+		// rows from the initial dump have no position and come before anything else.
+		pos := mysql.Position{Name: ev.Source.File, Pos: ev.Source.Pos}
+		if ev.Source.Pos != 0 && pos.Compare(s.position) > 0 {
+			return nil
+		}
+
+		if ev.Action == canal.UpdateAction || ev.Action == canal.DeleteAction {
+			key, err := streamKey(ev.Before, s.key)
+			if err != nil {
+				return errors.Wrapf(err, "offset %d", m.Offset)
+			}
+			delete(rows, key)
+		}
+		if ev.Action == canal.InsertAction || ev.Action == canal.UpdateAction {
+			key, err := streamKey(ev.After, s.key)
+			if err != nil {
+				return errors.Wrapf(err, "offset %d", m.Offset)
+			}
+			if key >= from && key <= to {
+				rows[key] = streamRow(ev.After, s.columns)
+			}
+		}
+		return nil
+	})
+	return rows, err
+}
+
+func streamKey(image map[string]interface{}, column string) (int64, error) {
+	n, ok := image[column].(json.Number)
+	if !ok {
+		return 0, errors.Errorf("key %s is %v, not a number", column, image[column])
+	}
+	return n.Int64()
+}
+
+// streamRow converts an image to the text form mysql uses for the same values.
+func streamRow(image map[string]interface{}, columns []string) row {
+	r := make(row, len(columns))
+	for i, c := range columns {
+		var v string
+		switch value := image[c].(type) {
+		case nil:
+			continue
+		case string:
+			v = value
+		case json.Number:
+			v = value.String()
+		case bool:
+			v = "0"
+			if value {
+				v = "1"
+			}
+		default:
+			v = fmt.Sprint(value)
+		}
+		r[i] = &v
+	}
+	return r
+}
@@ -8,6 +8,7 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/Shopify/reportify-query/common"
 	"github.com/highstead/bin-log-poc"
@@ -22,6 +23,8 @@ func main() {
 	var (
 		configdir = flag.String("c", "config", "config directory path")
 		debug     = flag.String("d", "true", "debug mode")
+		metrics   = flag.String("m", ":6060", "metrics and pprof listen address")
+		liveness  = flag.Duration("l", time.Minute, "time without binlog events before failing the liveness check")
 	)
 	flag.Parse()
 	if strings.ToLower(*debug) == "true" {
@@ -33,12 +36,19 @@ func main() {
 		log.SetLevel(log.InfoLevel)
 		log.SetFormatter(common.LogFormatter{Formatter: new(log.JSONFormatter)})
 	}
+	binlog.SetLogger(binlog.NewLogrusLogger(log.StandardLogger()))
+
+	binlog.LivenessThreshold = *liveness
+	binlog.ServeMetrics(*metrics)
 
 	secrets, err := binlog.ParseSecretsFile(*configdir)
 	if err != nil {
 		log.WithError(err).Panic("can't parse secrets file")
 	}
-	ctx := secrets.Master.OpenCanal(binlog.NewLoggerEventHandler())
+	if err := secrets.Validate(binlog.RequireMysql); err != nil {
+		log.Fatal(err)
+	}
+	ctx := secrets.MasterShard().OpenCanal(binlog.NewLoggerEventHandler())
 	log.Info("Canal Open")
 
 	gracefulShutdown(ctx)
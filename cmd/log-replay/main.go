@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"flag"
+	_ "net/http/pprof"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Shopify/reportify-query/common"
+	"github.com/highstead/bin-log-poc"
+	"github.com/siddontang/go-mysql/mysql"
+	log "github.com/sirupsen/logrus"
+)
+
+// log-replay runs binlog files archived by log-syncer through the same event handlers as
+// kafka-canal. Rows are decoded with the tables of a schema snapshot, which -snapshot
+// takes from the master.
+func main() {
+	log.SetFormatter(new(log.JSONFormatter))
+	log.Info("starting log-replay")
+
+	// Parse flags.
+	var (
+		configdir = flag.String("c", "config", "config directory path")
+		debug     = flag.String("d", "true", "debug mode")
+		metrics   = flag.String("m", ":6060", "metrics and pprof listen address")
+		archive   = flag.String("a", "binlogs", "directory of the archived binlog files")
+		schemas   = flag.String("s", "schema.json", "schema snapshot path")
+		snapshot  = flag.String("snapshot", "", "comma separated schema.table names to snapshot from the master to -s instead of replaying")
+		from      = flag.String("from", "", "file:pos to replay from, defaults to the start of the archive")
+		toKafka   = flag.Bool("k", false, "write the replayed events to kafka instead of logging them")
+	)
+	flag.Parse()
+	if strings.ToLower(*debug) == "true" {
+		log.SetLevel(log.DebugLevel)
+		log.SetOutput(os.Stdout)
+		log.SetFormatter(common.LogFormatter{Formatter: new(log.TextFormatter)})
+		log.Println("Logging in debug mode")
+	} else {
+		log.SetLevel(log.InfoLevel)
+		log.SetFormatter(common.LogFormatter{Formatter: new(log.JSONFormatter)})
+	}
+	binlog.SetLogger(binlog.NewLogrusLogger(log.StandardLogger()))
+
+	binlog.ServeMetrics(*metrics)
+
+	secrets, err := binlog.ParseSecretsFile(*configdir)
+	if err != nil {
+		log.WithError(err).Panic("can't parse secrets file")
+	}
+	var need binlog.Requirement
+	if *snapshot != "" {
+		need |= binlog.RequireMysql
+	} else if *toKafka {
+		need |= binlog.RequireKafka
+	}
+	if err := secrets.Validate(need); err != nil {
+		log.Fatal(err)
+	}
+
+	if *snapshot != "" {
+		takeSnapshot(secrets, *schemas, strings.Split(*snapshot, ","))
+		return
+	}
+
+	pos, err := parsePosition(*from)
+	if err != nil {
+		log.WithError(err).Fatal("invalid position to replay from")
+	}
+	tables, err := binlog.ReadSchemaSnapshot(*schemas)
+	if err != nil {
+		log.WithError(err).Fatal("can't read schema snapshot")
+	}
+
+	if !*toKafka {
+		if err := binlog.ReplayArchive(*archive, pos, tables, binlog.NewLoggerEventHandler()); err != nil {
+			log.WithError(err).Fatal("unable to replay archive")
+		}
+		log.Info("Replayed archive")
+		return
+	}
+
+	producer, err := secrets.Kafka.NewProducer()
+	if err != nil {
+		log.WithError(err).Panic("can't create kafka producer")
+	}
+	defer producer.Close()
+
+	eh := binlog.NewKafkaEventHandler(producer, secrets.Kafka.NewEncoder())
+	if secrets.Kafka.DeadLetterTopic != "" {
+		eh.EnableDeadLetters(secrets.Kafka.DeadLetterTopic)
+	}
+	interval := time.Second
+	if secrets.Kafka.FlushInterval > 0 {
+		interval = time.Duration(secrets.Kafka.FlushInterval)
+	}
+
+	// the events are written while the archive is replayed so that they don't pile up.
+	ctx, cancel := context.WithCancel(context.Background())
+	failed := eh.WriteErrors()
+	stopped := eh.AutoEmit(ctx, interval)
+	replayed := make(chan error, 1)
+	go func() {
+		replayed <- binlog.ReplayArchive(*archive, pos, tables, eh)
+	}()
+	select {
+	case err := <-replayed:
+		if err != nil {
+			log.WithError(err).Fatal("unable to replay archive")
+		}
+	case err := <-failed:
+		log.WithError(err).Fatal("unable to write replayed events")
+	}
+	cancel()
+	<-stopped
+
+	// what was read since the last write, and a write interrupted by the cancel.
+	if _, err := eh.WriteEvents(context.Background()); err != nil {
+		log.WithError(err).Fatal("unable to write replayed events")
+	}
+	log.Info("Replayed archive")
+}
+
+func takeSnapshot(secrets *binlog.Secrets, path string, tables []string) {
+	db, err := secrets.Master.Connect()
+	if err != nil {
+		log.WithError(err).Panic("can't connect to mysql")
+	}
+	defer db.Close()
+
+	s, err := binlog.TakeSchemaSnapshot(db, tables)
+	if err != nil {
+		log.WithError(err).Fatal("can't snapshot schema")
+	}
+	if err := s.Write(path); err != nil {
+		log.WithError(err).Fatal("can't write schema snapshot")
+	}
+	log.WithField("tables", len(s)).Info("Wrote schema snapshot")
+}
+
+func parsePosition(s string) (mysql.Position, error) {
+	if s == "" {
+		return mysql.Position{}, nil
+	}
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		return mysql.Position{Name: s}, nil
+	}
+	pos, err := strconv.ParseUint(s[i+1:], 10, 32)
+	return mysql.Position{Name: s[:i], Pos: uint32(pos)}, err
+}
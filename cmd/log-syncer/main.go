@@ -8,6 +8,7 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/Shopify/reportify-query/common"
 	"github.com/highstead/bin-log-poc"
@@ -22,6 +23,11 @@ func main() {
 	var (
 		configdir = flag.String("c", "config", "config directory path")
 		debug     = flag.String("d", "true", "debug mode")
+		metrics   = flag.String("m", ":6060", "metrics and pprof listen address")
+		liveness  = flag.Duration("l", time.Minute, "time without binlog events before failing the liveness check")
+		archive   = flag.String("a", "binlogs", "directory to archive the raw binlog files to")
+		compress  = flag.Bool("z", false, "gzip the archived binlog files")
+		interval  = flag.Duration("i", time.Second, "how often the archive is synced to disk")
 	)
 	flag.Parse()
 	if strings.ToLower(*debug) == "true" {
@@ -33,27 +39,73 @@ func main() {
 		log.SetLevel(log.InfoLevel)
 		log.SetFormatter(common.LogFormatter{Formatter: new(log.JSONFormatter)})
 	}
+	binlog.SetLogger(binlog.NewLogrusLogger(log.StandardLogger()))
+
+	binlog.LivenessThreshold = *liveness
+	binlog.ServeMetrics(*metrics)
 
 	secrets, err := binlog.ParseSecretsFile(*configdir)
 	if err != nil {
 		log.WithError(err).Panic("can't parse secrets file")
 	}
+	if err := secrets.Validate(binlog.RequireMysql); err != nil {
+		log.Fatal(err)
+	}
+	archiver, err := binlog.NewArchiver(*archive, *compress)
+	if err != nil {
+		log.WithError(err).Panic("can't open binlog archive")
+	}
+
 	syncer := secrets.Master.GetSyncer()
-	pos := syncer.GetNextPosition()
+	defer syncer.Close()
+	pos := archiver.Position()
+	if pos.Name == "" {
+		pos = syncer.GetNextPosition()
+	}
+	log.WithField("position", pos).Info("Archiving binlog")
 	streamer, err := syncer.StartSync(pos)
 	if err != nil {
 		log.WithError(err).Info("Unable to start streamer")
 		panic(err)
 	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
+		defer cancel()
 		for {
-			ev, _ := streamer.GetEvent(context.Background())
-			log.WithField("event", ev).Info("Recieved Input")
+			ev, err := streamer.GetEvent(ctx)
+			if err != nil {
+				log.WithError(err).Error("Unable to read binlog event")
+				return
+			}
+			binlog.ObserveEvent(ev)
+			log.WithField("event", ev.Header.EventType).Debug("Recieved Input")
+			if err := archiver.Write(ev); err != nil {
+				log.WithError(err).Error("Unable to archive binlog event")
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case <-time.After(*interval):
+				if err := archiver.Sync(); err != nil {
+					log.WithError(err).Error("Unable to sync binlog archive")
+					cancel()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
 		}
-
 	}()
 
-	gracefulShutdown(context.Background())
+	gracefulShutdown(ctx)
+	cancel()
+	if err := archiver.Close(); err != nil {
+		log.WithError(err).Error("Unable to close binlog archive")
+	}
 }
 
 func gracefulShutdown(ctx context.Context) {
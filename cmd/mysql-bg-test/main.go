@@ -2,15 +2,12 @@ package main
 
 import (
 	"context"
-	"database/sql"
 	"flag"
-	"fmt"
-	"math/rand"
+	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
-	"time"
 
 	"github.com/Shopify/reportify-query/common"
 	_ "github.com/go-sql-driver/mysql"
@@ -25,6 +22,17 @@ func main() {
 	var (
 		configdir = flag.String("c", "config", "config directory path")
 		debug     = flag.String("d", "true", "debug mode")
+		metrics   = flag.String("m", ":6060", "metrics and pprof listen address")
+		workers   = flag.Int("workers", 4, "number of concurrent workers")
+		rate      = flag.Float64("rate", 2, "target operations per second, 0 is unlimited")
+		mix       = flag.String("mix", "insert:2,update:1,delete:1", "relative weight of every operation")
+		batch     = flag.Int("batch", 1, "rows inserted, updated or deleted by every operation")
+		txnOps    = flag.Int("txn", 1, "operations committed together in one transaction")
+		skew      = flag.Float64("skew", 0, "zipf exponent over 1 favouring recent rows, 0 is uniform")
+		duration  = flag.Duration("duration", 0, "how long to run, 0 runs until stopped")
+		seed      = flag.Int64("seed", 44, "random seed, every worker adds its index to it")
+		tables    = flag.String("tables", "sales.sales", "comma separated schema.table names to generate load for")
+		truth     = flag.String("truth", "", "file to record every committed change and the row state it left in")
 	)
 	flag.Parse()
 	if strings.ToLower(*debug) == "true" {
@@ -36,193 +44,65 @@ func main() {
 		log.SetLevel(log.InfoLevel)
 		log.SetFormatter(common.LogFormatter{Formatter: new(log.JSONFormatter)})
 	}
+	binlog.SetLogger(binlog.NewLogrusLogger(log.StandardLogger()))
+
+	binlog.ServeMetrics(*metrics)
 
 	secrets, err := binlog.ParseSecretsFile(*configdir)
 	if err != nil {
 		log.WithError(err).Panic("unable to parse secrets file")
 	}
+	if err := secrets.Validate(binlog.RequireMysql); err != nil {
+		log.Fatal(err)
+	}
 
-	cancel := simpleProgram(secrets)
-	gracefulShutdown(cancel)
-
-}
-
-func gracefulShutdown(cancel context.CancelFunc) {
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
-
-	<-stop
-	log.Info("mysql-inserter is shutting down")
-	cancel()
-}
-
-type Sale struct {
-	value           int64
-	discountPercent int64
-}
-
-func (s *Sale) String() string {
-	return fmt.Sprintf("Sale value: %d, discount: %d", s.value, s.discountPercent)
-}
-
-func simpleProgram(secrets *binlog.Secrets) context.CancelFunc {
-	secrets.Master.MultiStatement = true
+	ops, err := ParseMix(*mix)
+	if err != nil {
+		log.WithError(err).Fatal("invalid operation mix")
+	}
 	conn, err := secrets.Master.Connect()
 	if err != nil {
 		log.WithError(err).Panic("Unable to connect to mysql database")
 	}
-
-	ctx, cancel := context.WithCancel(context.Background())
-	insertChannel := make(chan *Sale, 10)
-	transChannel := make(chan *Sale, 10)
-	updateChannel := make(chan *Sale, 10)
-	delChannel := make(chan bool, 10)
-
-	r := rand.New(rand.NewSource(44))
-
-	go func() {
-		for {
-			dur := time.Duration(r.Int31n(2000)) * time.Millisecond
-			select {
-			case <-ctx.Done():
-				log.Info("context done")
-				return
-			case <-time.After(dur):
-				insertChannel <- &Sale{
-					value:           r.Int63n(10000),
-					discountPercent: r.Int63n(3000),
-				}
-			}
-		}
-	}()
-
-	go func() {
-		for {
-			dur := time.Duration(r.Int31n(2000)) * time.Millisecond
-			select {
-			case <-ctx.Done():
-				log.Info("context done")
-				return
-			case <-time.After(dur):
-				updateChannel <- &Sale{
-					value:           r.Int63n(10000),
-					discountPercent: r.Int63n(3000),
-				}
-			}
+	var truthLog *binlog.TruthLog
+	if *truth != "" {
+		if truthLog, err = binlog.CreateTruthLog(*truth); err != nil {
+			log.WithError(err).Fatal("can't create ground truth log")
 		}
-	}()
-
-	go func() {
-		for {
-			dur := time.Duration(r.Int31n(2000)) * time.Millisecond
-			select {
-			case <-ctx.Done():
-				log.Info("context done")
-				return
-			case <-time.After(dur):
-				transChannel <- &Sale{
-					value:           r.Int63n(10000),
-					discountPercent: r.Int63n(3000),
-				}
-			}
-		}
-	}()
+		defer truthLog.Close()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	g, err := newGenerator(ctx, conn, &Workload{
+		Workers:  *workers,
+		Rate:     *rate,
+		Mix:      ops,
+		Batch:    *batch,
+		TxnOps:   *txnOps,
+		Skew:     *skew,
+		Duration: *duration,
+		Seed:     *seed,
+	}, strings.Split(*tables, ","), truthLog)
+	if err != nil {
+		log.WithError(err).Fatal("invalid workload")
+	}
 
+	done := make(chan struct{})
 	go func() {
-		for {
-			dur := time.Duration(r.Int31n(2000)) * time.Millisecond
-			select {
-			case <-ctx.Done():
-				log.Info("context done")
-				return
-			case <-time.After(dur):
-				delChannel <- true
-			}
-		}
+		g.Run(ctx)
+		close(done)
 	}()
-
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				log.Info("context done")
-				return
-			case s := <-insertChannel:
-				err := inserter(ctx, conn, s)
-				if err != nil {
-					log.WithField("type", "insert").WithError(err).Println("unable to insert record")
-				} else {
-					log.WithField("type", "insert").Debug(s)
-				}
-			case s := <-transChannel:
-				err := transInsert(ctx, conn, s)
-				if err != nil {
-					log.WithField("type", "trans").WithError(err).Println("unable to trans-insert record")
-				} else {
-					log.WithField("type", "trans").Debug(s)
-				}
-			case s := <-updateChannel:
-				err := updater(ctx, conn, s)
-				if err != nil {
-					log.WithField("type", "update").WithError(err).Println("unable to trans-insert record")
-				} else {
-					log.WithField("type", "update").Debug(s)
-				}
-			case <-delChannel:
-				err := deleter(ctx, conn)
-				if err != nil {
-					log.WithField("type", "del").WithError(err).Println("unable to delete record")
-				} else {
-					log.WithField("type", "del").Debug("delete")
-				}
-			}
-		}
-	}()
-
-	return cancel
-
-}
-
-func inserter(ctx context.Context, conn *sql.DB, s *Sale) error {
-	query := "INSERT INTO sales.sales(happened_at, currency, created_at, amount_displayed, discount_percent) VALUES(NOW(), 'CAD', NOW(), ?, ?);"
-	_, err := conn.ExecContext(ctx, query, s.value/100, s.discountPercent/100)
-	return err
-}
-
-func transInsert(ctx context.Context, conn *sql.DB, s *Sale) error {
-	query := `
-		START TRANSACTION;
-		SET @saleNum = (SELECT MAX(id)+1 FROM sales.sales);
-		INSERT INTO sales.sales(id, happened_at, currency, created_at, amount_displayed, discount_percent) VALUES(@saleNum, NOW(), 'CAD', NOW(), ?, ?);
-		COMMIT;
-	`
-	_, err := conn.ExecContext(ctx, query, s.value/100, s.discountPercent/100)
-	return err
+	gracefulShutdown(done)
+	cancel()
+	<-done
 }
 
-func updater(ctx context.Context, conn *sql.DB, s *Sale) error {
-	query := `
-		START TRANSACTION;
-		SET @saleNum = (SELECT MAX(id)-2 FROM sales.sales);
-		UPDATE sales.sales SET
-		  currency = 'UPD',
-		  amount_displayed = ?,
-		  discount_percent = ?
-		WHERE 
-		  id = @saleNum;
-		COMMIT;
-	`
-	_, err := conn.ExecContext(ctx, query, s.value/100, s.discountPercent/100)
-	return err
-}
+func gracefulShutdown(done <-chan struct{}) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
-func deleter(ctx context.Context, conn *sql.DB) error {
-	query := `
-		START TRANSACTION;
-		SET @delNum = (SELECT MAX(id) FROM sales.sales);
-		DELETE FROM sales.sales WHERE id = @delNum;
-		COMMIT;
-	`
-	_, err := conn.ExecContext(ctx, query)
-	return err
+	select {
+	case <-stop:
+		log.Info("mysql-inserter is shutting down")
+	case <-done:
+	}
 }
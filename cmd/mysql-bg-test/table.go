@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// nullPercent is how often nullable columns are set to NULL.
+const nullPercent = 10
+
+// column is what's needed from information_schema to generate values for a column.
+type column struct {
+	Name       string
+	DataType   string
+	ColumnType string
+	Nullable   bool
+	Extra      string
+	MaxLength  sql.NullInt64
+	Precision  sql.NullInt64
+	Scale      sql.NullInt64
+
+	// references holds values of the column referenced by a foreign key.
+	references []interface{}
+}
+
+func (c *column) unsigned() bool {
+	return strings.Contains(c.ColumnType, "unsigned")
+}
+
+// generated columns are computed by mysql and auto increment ones are left to it.
+func (c *column) generated() bool {
+	extra := strings.ToLower(c.Extra)
+	return strings.Contains(extra, "auto_increment") || strings.Contains(extra, "generated")
+}
+
+// table is a table the workload writes to, with a single column primary key.
+type table struct {
+	Schema  string
+	Name    string
+	Columns []*column
+	Key     *column
+
+	// minID and maxID bound the keys of tables with an auto increment key. Updates and
+	// deletes pick keys between them, other tables are probed with random keys.
+	minID int64
+	maxID int64
+}
+
+func (t *table) String() string {
+	return quote(t.Schema) + "." + quote(t.Name)
+}
+
+func (t *table) autoIncrement() bool {
+	return strings.Contains(strings.ToLower(t.Key.Extra), "auto_increment")
+}
+
+// loadTable reads the columns, primary key and foreign keys of schema.name.
+func loadTable(ctx context.Context, db *sql.DB, name string) (*table, error) {
+	parts := strings.SplitN(name, ".", 2)
+	if len(parts) != 2 {
+		return nil, errors.Errorf("table %q must be given as schema.table", name)
+	}
+	t := &table{Schema: parts[0], Name: parts[1]}
+
+	rows, err := db.QueryContext(ctx, `SELECT COLUMN_NAME, DATA_TYPE, COLUMN_TYPE, IS_NULLABLE = 'YES', EXTRA,
+			CHARACTER_MAXIMUM_LENGTH, NUMERIC_PRECISION, NUMERIC_SCALE
+		FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION`, t.Schema, t.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		c := &column{}
+		err := rows.Scan(&c.Name, &c.DataType, &c.ColumnType, &c.Nullable, &c.Extra, &c.MaxLength, &c.Precision, &c.Scale)
+		if err != nil {
+			return nil, err
+		}
+		c.DataType = strings.ToLower(c.DataType)
+		t.Columns = append(t.Columns, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(t.Columns) == 0 {
+		return nil, errors.Errorf("table %s does not exist", name)
+	}
+
+	if err := t.loadKeys(ctx, db); err != nil {
+		return nil, errors.Wrapf(err, "cannot read keys of %s", name)
+	}
+	if t.autoIncrement() {
+		var lo, hi sql.NullInt64
+		query := fmt.Sprintf("SELECT MIN(%s), MAX(%s) FROM %s", quote(t.Key.Name), quote(t.Key.Name), t)
+		if err := db.QueryRowContext(ctx, query).Scan(&lo, &hi); err != nil {
+			return nil, errors.Wrapf(err, "cannot read keys of %s", name)
+		}
+		t.minID, t.maxID = lo.Int64, hi.Int64
+	}
+	return t, nil
+}
+
+func (t *table) loadKeys(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, `SELECT COLUMN_NAME, CONSTRAINT_NAME,
+			REFERENCED_TABLE_SCHEMA, REFERENCED_TABLE_NAME, REFERENCED_COLUMN_NAME
+		FROM information_schema.KEY_COLUMN_USAGE
+		WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ?`, t.Schema, t.Name)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type reference struct {
+		column               *column
+		schema, table, field string
+	}
+	var keys []*column
+	var refs []reference
+	for rows.Next() {
+		var name, constraint string
+		var refSchema, refTable, refColumn sql.NullString
+		if err := rows.Scan(&name, &constraint, &refSchema, &refTable, &refColumn); err != nil {
+			return err
+		}
+		c := t.column(name)
+		if c == nil {
+			continue
+		}
+		if constraint == "PRIMARY" {
+			keys = append(keys, c)
+		}
+		if refTable.Valid {
+			refs = append(refs, reference{c, refSchema.String, refTable.String, refColumn.String})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	if len(keys) != 1 {
+		return errors.Errorf("a single column primary key is needed, %s has %d", t, len(keys))
+	}
+	t.Key = keys[0]
+
+	for _, ref := range refs {
+		query := fmt.Sprintf("SELECT DISTINCT %s FROM %s.%s LIMIT 1000", quote(ref.field), quote(ref.schema), quote(ref.table))
+		values, err := queryColumn(ctx, db, query)
+		if err != nil {
+			return errors.Wrapf(err, "cannot read values referenced by %s", ref.column.Name)
+		}
+		ref.column.references = values
+	}
+	return nil
+}
+
+func (t *table) column(name string) *column {
+	for _, c := range t.Columns {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// writable are the columns the workload sets values for.
+func (t *table) writable() []*column {
+	var cols []*column
+	for _, c := range t.Columns {
+		if !c.generated() {
+			cols = append(cols, c)
+		}
+	}
+	return cols
+}
+
+// updatable are the columns updates set new values for.
+func (t *table) updatable() []*column {
+	var cols []*column
+	for _, c := range t.writable() {
+		if c != t.Key {
+			cols = append(cols, c)
+		}
+	}
+	return cols
+}
+
+// pickKeys picks n keys of existing rows, favouring the newest ones when zipf is set and
+// the key is auto incremented.
+func (t *table) pickKeys(ctx context.Context, q querier, r *rand.Rand, zipf *rand.Zipf, n int) ([]interface{}, error) {
+	if !t.autoIncrement() {
+		// probe from a random key, wrapping around to the first keys.
+		query := fmt.Sprintf("SELECT %s FROM %s WHERE %s >= ? ORDER BY %s LIMIT %d",
+			quote(t.Key.Name), t, quote(t.Key.Name), quote(t.Key.Name), n)
+		probe, err := t.Key.value(r)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := queryColumn(ctx, q, query, probe)
+		if err != nil || len(keys) > 0 {
+			return keys, err
+		}
+		query = fmt.Sprintf("SELECT %s FROM %s ORDER BY %s LIMIT %d", quote(t.Key.Name), t, quote(t.Key.Name), n)
+		return queryColumn(ctx, q, query)
+	}
+
+	max := atomic.LoadInt64(&t.maxID)
+	span := max - t.minID
+	keys := make([]interface{}, n)
+	for i := range keys {
+		switch {
+		case span <= 0:
+			keys[i] = max
+		case zipf != nil:
+			keys[i] = max - int64(zipf.Uint64()%uint64(span+1))
+		default:
+			keys[i] = t.minID + r.Int63n(span+1)
+		}
+	}
+	return keys, nil
+}
+
+func (t *table) observeID(id int64) {
+	for {
+		max := atomic.LoadInt64(&t.maxID)
+		if id <= max || atomic.CompareAndSwapInt64(&t.maxID, max, id) {
+			return
+		}
+	}
+}
+
+// value returns a random value that is valid for the column.
+func (c *column) value(r *rand.Rand) (interface{}, error) {
+	if len(c.references) > 0 {
+		return c.references[r.Intn(len(c.references))], nil
+	}
+	if c.Nullable && r.Intn(100) < nullPercent {
+		return nil, nil
+	}
+
+	switch c.DataType {
+	case "tinyint", "smallint", "mediumint", "int", "integer", "bigint":
+		return c.integer(r), nil
+	case "decimal", "numeric":
+		return c.decimal(r), nil
+	case "float", "double", "real":
+		return float64(r.Int63n(100000)) / 100, nil
+	case "bit":
+		bits := c.Precision.Int64
+		if bits < 1 || bits > 62 {
+			bits = 62
+		}
+		return r.Int63n(1 << uint(bits)), nil
+	case "char", "varchar", "tinytext", "text", "mediumtext", "longtext":
+		return randomString(r, c.length(32)), nil
+	case "binary", "varbinary", "tinyblob", "blob", "mediumblob", "longblob":
+		b := make([]byte, c.length(16))
+		r.Read(b)
+		return b, nil
+	case "date":
+		return randomTime(r).Format("2006-01-02"), nil
+	case "datetime", "timestamp":
+		return randomTime(r).Format("2006-01-02 15:04:05"), nil
+	case "time":
+		return randomTime(r).Format("15:04:05"), nil
+	case "year":
+		return 2000 + r.Intn(30), nil
+	case "enum":
+		values := c.options()
+		if len(values) == 0 {
+			return nil, errors.Errorf("enum %s has no values", c.Name)
+		}
+		return values[r.Intn(len(values))], nil
+	case "set":
+		var picked []string
+		for _, v := range c.options() {
+			if r.Intn(2) == 0 {
+				picked = append(picked, v)
+			}
+		}
+		return strings.Join(picked, ","), nil
+	case "json":
+		b, err := json.Marshal(map[string]interface{}{
+			"n": r.Int63n(10000),
+			"s": randomString(r, 8),
+			"b": r.Intn(2) == 0,
+		})
+		return string(b), err
+	}
+
+	if c.Nullable {
+		return nil, nil
+	}
+	return nil, errors.Errorf("cannot generate %s values for %s", c.DataType, c.Name)
+}
+
+func (c *column) integer(r *rand.Rand) int64 {
+	bits := map[string]uint{"tinyint": 8, "smallint": 16, "mediumint": 24}[c.DataType]
+	if bits == 0 {
+		// keep int and bigint values far from overflowing.
+		bits = 32
+	}
+	if c.unsigned() {
+		return r.Int63n(1 << bits)
+	}
+	return r.Int63n(1<<bits) - 1<<(bits-1)
+}
+
+func (c *column) decimal(r *rand.Rand) string {
+	precision, scale := c.Precision.Int64, c.Scale.Int64
+	if precision == 0 {
+		precision = 10
+	}
+	digits := precision - scale
+	if digits > 9 {
+		digits = 9
+	}
+	whole := int64(0)
+	if digits > 0 {
+		whole = r.Int63n(pow10(digits))
+	}
+	if scale == 0 {
+		return strconv.FormatInt(whole, 10)
+	}
+	if scale > 9 {
+		scale = 9
+	}
+	return fmt.Sprintf("%d.%0*d", whole, int(scale), r.Int63n(pow10(scale)))
+}
+
+func (c *column) length(max int64) int {
+	n := max
+	if c.MaxLength.Valid && c.MaxLength.Int64 < n {
+		n = c.MaxLength.Int64
+	}
+	if n < 1 {
+		n = 1
+	}
+	return int(n)
+}
+
+// options parses the values out of enum('a','b') and set('a','b') column types.
+func (c *column) options() []string {
+	open, end := strings.Index(c.ColumnType, "("), strings.LastIndex(c.ColumnType, ")")
+	if open < 0 || end <= open {
+		return nil
+	}
+	var values []string
+	for _, v := range strings.Split(c.ColumnType[open+1:end], "','") {
+		values = append(values, strings.Replace(strings.Trim(v, "'"), "''", "'", -1))
+	}
+	return values
+}
+
+func pow10(n int64) int64 {
+	p := int64(1)
+	for i := int64(0); i < n; i++ {
+		p *= 10
+	}
+	return p
+}
+
+const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+func randomString(r *rand.Rand, max int) string {
+	b := make([]byte, 1+r.Intn(max))
+	for i := range b {
+		b[i] = letters[r.Intn(len(letters))]
+	}
+	return string(b)
+}
+
+// randomTime is within the range of every mysql time type.
+func randomTime(r *rand.Rand) time.Time {
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	return start.Add(time.Duration(r.Int63n(int64(30 * 365 * 24 * time.Hour))))
+}
+
+// querier is a *sql.DB or *sql.Tx.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func queryColumn(ctx context.Context, q querier, query string, args ...interface{}) ([]interface{}, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []interface{}
+	for rows.Next() {
+		var v interface{}
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+func quote(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
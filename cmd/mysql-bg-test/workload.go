@@ -0,0 +1,536 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/highstead/bin-log-poc"
+	"github.com/pkg/errors"
+	"github.com/siddontang/go-mysql/canal"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	insertOp = "insert"
+	updateOp = "update"
+	deleteOp = "delete"
+)
+
+// Workload describes the load to generate.
+type Workload struct {
+	Workers int
+	// Rate is the target number of operations per second across all workers, 0 runs
+	// as fast as possible.
+	Rate float64
+	// Mix is the relative weight of every operation.
+	Mix map[string]int
+	// Batch is the number of rows every operation inserts, updates or deletes.
+	Batch int
+	// TxnOps is the number of operations committed together in one transaction.
+	TxnOps int
+	// Skew makes updates and deletes favour recently inserted rows of tables with an auto
+	// increment key following a zipf distribution with this exponent, it has to be over 1.
+	// Keys are uniform when it is 0.
+	Skew float64
+	// Duration stops the workload after that long, it runs until stopped when 0.
+	Duration time.Duration
+	Seed     int64
+}
+
+// ParseMix parses weights given as op:weight,op:weight.
+func ParseMix(s string) (map[string]int, error) {
+	mix := make(map[string]int)
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), ":", 2)
+		if len(kv) != 2 {
+			return nil, errors.Errorf("invalid mix %q, expected op:weight", part)
+		}
+		switch kv[0] {
+		case insertOp, updateOp, deleteOp:
+		default:
+			return nil, errors.Errorf("unknown op %q", kv[0])
+		}
+		weight, err := strconv.Atoi(kv[1])
+		if err != nil || weight < 0 {
+			return nil, errors.Errorf("invalid weight %q for %s", kv[1], kv[0])
+		}
+		mix[kv[0]] = weight
+	}
+	return mix, nil
+}
+
+func (w *Workload) validate() error {
+	total := 0
+	for _, weight := range w.Mix {
+		total += weight
+	}
+	switch {
+	case w.Workers < 1:
+		return errors.New("workers must be positive")
+	case w.Batch < 1:
+		return errors.New("batch must be positive")
+	case w.TxnOps < 1:
+		return errors.New("transaction ops must be positive")
+	case w.Skew != 0 && w.Skew <= 1:
+		return errors.New("skew must be over 1")
+	case total == 0:
+		return errors.New("mix has no weight")
+	}
+	return nil
+}
+
+// opCounts counts an operation's outcomes, it is updated atomically.
+type opCounts struct {
+	ops    int64
+	rows   int64
+	errors int64
+}
+
+type stats struct {
+	start time.Time
+	ops   map[string]*opCounts
+}
+
+func newStats() *stats {
+	return &stats{
+		start: time.Now(),
+		ops: map[string]*opCounts{
+			insertOp: {},
+			updateOp: {},
+			deleteOp: {},
+		},
+	}
+}
+
+func (s *stats) fields() log.Fields {
+	elapsed := time.Since(s.start).Seconds()
+	fields := log.Fields{"elapsed": time.Since(s.start).Round(time.Second).String()}
+	var total int64
+	for op, c := range s.ops {
+		ops := atomic.LoadInt64(&c.ops)
+		total += ops
+		fields[op+"s"] = ops
+		fields[op+"_rows"] = atomic.LoadInt64(&c.rows)
+		fields[op+"_errors"] = atomic.LoadInt64(&c.errors)
+	}
+	fields["ops_per_sec"] = fmt.Sprintf("%.1f", float64(total)/elapsed)
+	return fields
+}
+
+// generator runs a workload against a set of tables.
+type generator struct {
+	w      *Workload
+	db     *sql.DB
+	tables []*table
+	stats  *stats
+	ops    []string
+	// truth records every committed change when set.
+	truth *binlog.TruthLog
+}
+
+func newGenerator(ctx context.Context, db *sql.DB, w *Workload, tables []string, truth *binlog.TruthLog) (*generator, error) {
+	if err := w.validate(); err != nil {
+		return nil, err
+	}
+	g := &generator{w: w, db: db, stats: newStats(), truth: truth}
+	ops := make([]string, 0, len(w.Mix))
+	for op := range w.Mix {
+		ops = append(ops, op)
+	}
+	// map order is random, the choice of ops has to be reproducible.
+	sort.Strings(ops)
+	for _, op := range ops {
+		for i := 0; i < w.Mix[op]; i++ {
+			g.ops = append(g.ops, op)
+		}
+	}
+
+	for _, name := range tables {
+		t, err := loadTable(ctx, db, name)
+		if err != nil {
+			return nil, err
+		}
+		g.tables = append(g.tables, t)
+	}
+	if len(g.tables) == 0 {
+		return nil, errors.New("no tables to generate load for")
+	}
+	return g, nil
+}
+
+// Run generates load until ctx is done or the workload's duration is over, and returns
+// once every worker has stopped.
+func (g *generator) Run(ctx context.Context) {
+	if g.w.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.w.Duration)
+		defer cancel()
+	}
+
+	tokens := g.limit(ctx)
+	go g.report(ctx)
+
+	wg := new(sync.WaitGroup)
+	for i := 0; i < g.w.Workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			g.work(ctx, rand.New(rand.NewSource(g.w.Seed+int64(i))), tokens)
+		}(i)
+	}
+	wg.Wait()
+	log.WithFields(g.stats.fields()).Info("Workload done")
+}
+
+// limit returns a channel with a token for every operation allowed by the rate, or nil
+// when the rate is unlimited.
+func (g *generator) limit(ctx context.Context) <-chan struct{} {
+	if g.w.Rate <= 0 {
+		return nil
+	}
+	tokens := make(chan struct{}, g.w.Workers)
+	go func() {
+		t := time.NewTicker(time.Duration(float64(time.Second) / g.w.Rate))
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				select {
+				case tokens <- struct{}{}:
+				default:
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return tokens
+}
+
+func (g *generator) report(ctx context.Context) {
+	for {
+		select {
+		case <-time.After(10 * time.Second):
+			log.WithFields(g.stats.fields()).Info("Workload progress")
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// work runs transactions of TxnOps operations until ctx is done.
+func (g *generator) work(ctx context.Context, r *rand.Rand, tokens <-chan struct{}) {
+	for {
+		ops := make([]string, g.w.TxnOps)
+		tables := make([]*table, g.w.TxnOps)
+		for i := range ops {
+			if tokens != nil {
+				select {
+				case <-tokens:
+				case <-ctx.Done():
+					return
+				}
+			}
+			ops[i] = g.ops[r.Intn(len(g.ops))]
+			tables[i] = g.tables[r.Intn(len(g.tables))]
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err := g.txn(ctx, r, ops, tables); err != nil && ctx.Err() == nil {
+			log.WithError(err).Warn("transaction failed")
+		}
+	}
+}
+
+func (g *generator) txn(ctx context.Context, r *rand.Rand, ops []string, tables []*table) error {
+	tx, err := g.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows := make([]int64, len(ops))
+	var changes []binlog.TruthRecord
+	for i, op := range ops {
+		t := tables[i]
+		var changed []binlog.TruthRecord
+		var keys []interface{}
+		switch op {
+		case insertOp:
+			rows[i], changed, err = g.insert(ctx, tx, r, t)
+		case updateOp:
+			if keys, err = t.pickKeys(ctx, tx, r, g.zipf(r, t), g.w.Batch); err == nil {
+				rows[i], changed, err = g.update(ctx, tx, r, t, keys)
+			}
+		case deleteOp:
+			if keys, err = t.pickKeys(ctx, tx, r, g.zipf(r, t), g.w.Batch); err == nil {
+				rows[i], changed, err = g.delete(ctx, tx, t, keys)
+			}
+		}
+		if err != nil {
+			atomic.AddInt64(&g.stats.ops[op].errors, 1)
+			return errors.Wrapf(err, "cannot %s %s", op, t)
+		}
+		changes = append(changes, changed...)
+	}
+
+	if g.truth != nil {
+		err = g.truth.Commit(tx, changes)
+	} else {
+		err = tx.Commit()
+	}
+	if err != nil {
+		for _, op := range ops {
+			atomic.AddInt64(&g.stats.ops[op].errors, 1)
+		}
+		return err
+	}
+
+	for i, op := range ops {
+		atomic.AddInt64(&g.stats.ops[op].ops, 1)
+		atomic.AddInt64(&g.stats.ops[op].rows, rows[i])
+	}
+	log.WithField("ops", ops).Debug("committed transaction")
+	return nil
+}
+
+// zipf returns nil when keys should be picked uniformly.
+func (g *generator) zipf(r *rand.Rand, t *table) *rand.Zipf {
+	span := atomic.LoadInt64(&t.maxID) - t.minID
+	if g.w.Skew == 0 || span <= 0 {
+		return nil
+	}
+	return rand.NewZipf(r, g.w.Skew, 1, uint64(span))
+}
+
+func (g *generator) insert(ctx context.Context, tx *sql.Tx, r *rand.Rand, t *table) (int64, []binlog.TruthRecord, error) {
+	cols := t.writable()
+	names := make([]string, len(cols))
+	for i, c := range cols {
+		names[i] = quote(c.Name)
+	}
+	values := make([]string, g.w.Batch)
+	args := make([]interface{}, 0, len(cols)*g.w.Batch)
+	var keys []interface{}
+	for i := range values {
+		values[i] = "(" + placeholders(len(cols)) + ")"
+		for _, c := range cols {
+			v, err := c.value(r)
+			if err != nil {
+				return 0, nil, err
+			}
+			if c == t.Key {
+				keys = append(keys, v)
+			}
+			args = append(args, v)
+		}
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", t, strings.Join(names, ", "), strings.Join(values, ", "))
+	res, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, nil, err
+	}
+	if t.autoIncrement() {
+		// the ids of a multi-row insert are consecutive from the first one.
+		first, err := res.LastInsertId()
+		if err != nil {
+			return n, nil, nil
+		}
+		t.observeID(first + n - 1)
+		keys = make([]interface{}, n)
+		for i := range keys {
+			keys[i] = first + int64(i)
+		}
+	}
+	if g.truth == nil {
+		return n, nil, nil
+	}
+
+	after, err := g.rowStates(ctx, tx, t, keys)
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, truthRecords(t, canal.InsertAction, keys, nil, after), nil
+}
+
+func (g *generator) update(ctx context.Context, tx *sql.Tx, r *rand.Rand, t *table, keys []interface{}) (int64, []binlog.TruthRecord, error) {
+	cols := t.updatable()
+	if len(keys) == 0 || len(cols) == 0 {
+		return 0, nil, nil
+	}
+	var before map[string]map[string]*string
+	var err error
+	if g.truth != nil {
+		if before, err = g.rowStates(ctx, tx, t, keys); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	sets := make([]string, len(cols))
+	args := make([]interface{}, 0, len(cols)+len(keys))
+	for i, c := range cols {
+		v, err := c.value(r)
+		if err != nil {
+			return 0, nil, err
+		}
+		sets[i] = quote(c.Name) + " = ?"
+		args = append(args, v)
+	}
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE %s IN (%s)", t, strings.Join(sets, ", "), quote(t.Key.Name), placeholders(len(keys)))
+	res, err := tx.ExecContext(ctx, query, append(args, keys...)...)
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || g.truth == nil {
+		return n, nil, err
+	}
+
+	after, err := g.rowStates(ctx, tx, t, keys)
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, truthRecords(t, canal.UpdateAction, keys, before, after), nil
+}
+
+func (g *generator) delete(ctx context.Context, tx *sql.Tx, t *table, keys []interface{}) (int64, []binlog.TruthRecord, error) {
+	if len(keys) == 0 {
+		return 0, nil, nil
+	}
+	var before map[string]map[string]*string
+	var err error
+	if g.truth != nil {
+		if before, err = g.rowStates(ctx, tx, t, keys); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	query := fmt.Sprintf("DELETE FROM %s WHERE %s IN (%s)", t, quote(t.Key.Name), placeholders(len(keys)))
+	res, err := tx.ExecContext(ctx, query, keys...)
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || g.truth == nil {
+		return n, nil, err
+	}
+	return n, truthRecords(t, canal.DeleteAction, keys, before, nil), nil
+}
+
+// rowStates locks and reads the rows with the given keys, keyed by the text form of the
+// key.
+func (g *generator) rowStates(ctx context.Context, tx *sql.Tx, t *table, keys []interface{}) (map[string]map[string]*string, error) {
+	query := fmt.Sprintf("SELECT * FROM %s WHERE %s IN (%s) FOR UPDATE", t, quote(t.Key.Name), placeholders(len(keys)))
+	rows, err := tx.QueryContext(ctx, query, keys...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	states := make(map[string]map[string]*string)
+	for rows.Next() {
+		raw := make([]sql.RawBytes, len(cols))
+		dest := make([]interface{}, len(cols))
+		for i := range raw {
+			dest[i] = &raw[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		state := make(map[string]*string, len(cols))
+		for i, b := range raw {
+			if b != nil {
+				v := string(b)
+				state[cols[i]] = &v
+			} else {
+				state[cols[i]] = nil
+			}
+		}
+		if key := state[t.Key.Name]; key != nil {
+			states[*key] = state
+		}
+	}
+	return states, rows.Err()
+}
+
+// truthRecords returns a record for every row the action changed. Rows an update left as
+// they were are not in the binlog, so they are left out.
+func truthRecords(t *table, action string, keys []interface{}, before, after map[string]map[string]*string) []binlog.TruthRecord {
+	var records []binlog.TruthRecord
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		key := keyText(k)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		b, a := before[key], after[key]
+		switch action {
+		case canal.InsertAction:
+			if a == nil {
+				continue
+			}
+		case canal.UpdateAction:
+			if a == nil || sameState(b, a) {
+				continue
+			}
+		case canal.DeleteAction:
+			if b == nil {
+				continue
+			}
+		}
+		records = append(records, binlog.TruthRecord{
+			Schema: t.Schema,
+			Table:  t.Name,
+			Action: action,
+			Key:    key,
+			Row:    a,
+		})
+	}
+	return records
+}
+
+// keyText is the text form mysql returns a key in.
+func keyText(k interface{}) string {
+	if b, ok := k.([]byte); ok {
+		return string(b)
+	}
+	return fmt.Sprint(k)
+}
+
+func sameState(a, b map[string]*string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for c, v := range a {
+		w, ok := b[c]
+		if !ok || (v == nil) != (w == nil) || (v != nil && *v != *w) {
+			return false
+		}
+	}
+	return true
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
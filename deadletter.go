@@ -0,0 +1,110 @@
+package binlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+// DeadLetter wraps a row change that could not be converted or routed, along with the
+// reason, so that it can be replayed once the problem has been fixed.
+type DeadLetter struct {
+	Error  string        `json:"error"`
+	Table  TableInfo     `json:"table"`
+	Action string        `json:"action"`
+	Before []interface{} `json:"before,omitempty"`
+	After  []interface{} `json:"after,omitempty"`
+	Source Source        `json:"source"`
+	Time   time.Time     `json:"time"`
+}
+
+func deadLetterMessage(topic string, cause error, t TableInfo, action string, before, after []interface{}, src Source) (kafka.Message, error) {
+	dl := DeadLetter{
+		Error:  cause.Error(),
+		Table:  t,
+		Action: action,
+		Before: rawRow(before),
+		After:  rawRow(after),
+		Source: src,
+		Time:   time.Now(),
+	}
+	msg, err := dl.Message(topic)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+	deadLetters.WithLabelValues(src.Shard, t.Schema, t.Name).Inc()
+	return msg, nil
+}
+
+// Message encodes the dead letter for topic.
+func (dl *DeadLetter) Message(topic string) (kafka.Message, error) {
+	value, err := json.Marshal(dl)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+	return kafka.Message{
+		Topic: topic,
+		Key:   []byte(dl.Table.Schema + "." + dl.Table.Name),
+		Value: value,
+		Time:  dl.Time,
+	}, nil
+}
+
+// ParseDeadLetter decodes a dead letter, keeping numbers as json.Number so that large
+// integers survive the round trip.
+func ParseDeadLetter(value []byte) (*DeadLetter, error) {
+	dl := &DeadLetter{}
+	d := json.NewDecoder(bytes.NewReader(value))
+	d.UseNumber()
+	if err := d.Decode(dl); err != nil {
+		return nil, err
+	}
+	return dl, nil
+}
+
+// Refresh applies the current schema of the dead letter's table, so that a fix like an
+// added primary key is taken into account when it is replayed. The recorded columns are
+// kept when the table has gained or lost columns since, as the rows are in their order.
+func (dl *DeadLetter) Refresh(t *schema.Table) {
+	current := tableInfoOf(t)
+	if len(current.Columns) == len(dl.Table.Columns) {
+		dl.Table = current
+		return
+	}
+	recorded := make(map[string]bool, len(dl.Table.Columns))
+	for _, c := range dl.Table.Columns {
+		recorded[c] = true
+	}
+	for _, c := range current.PrimaryKey {
+		if !recorded[c] {
+			return
+		}
+	}
+	dl.Table.PrimaryKey = current.PrimaryKey
+}
+
+// Replay converts the dead letter's row again.
+func (dl *DeadLetter) Replay(e *Encoder) ([]kafka.Message, error) {
+	return e.Encode(dl.Table, dl.Action, dl.Before, dl.After, dl.Source)
+}
+
+// rawRow keeps every value that can be serialized as is and falls back to its printed
+// form for the rest.
+func rawRow(row []interface{}) []interface{} {
+	if row == nil {
+		return nil
+	}
+	raw := make([]interface{}, len(row))
+	for i, v := range row {
+		value, err := jsonValue(v)
+		if err != nil {
+			value = fmt.Sprintf("%v", v)
+		}
+		raw[i] = value
+	}
+	return raw
+}
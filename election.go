@@ -0,0 +1,184 @@
+package binlog
+
+import (
+	"context"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+const (
+	DefaultZkSessionTimeout = 10 * time.Second
+	// LeaderRetryInterval is how long to wait before trying to acquire leadership again
+	// after failing to.
+	LeaderRetryInterval = 5 * time.Second
+)
+
+// LeaderLock is held by at most one of the processes streaming a shard.
+type LeaderLock interface {
+	// Acquire blocks until the lock is held or ctx is done. The returned channel is closed
+	// once the lock may no longer be held, such as when the session holding it is lost.
+	Acquire(ctx context.Context) (lost <-chan struct{}, err error)
+	Release() error
+}
+
+// NewLeaderLock returns the zookeeper lock of a shard, it is a node under
+// RootPath/leaders named after the shard's source id.
+func (s *Secrets) NewLeaderLock(sh *ShardConfig) LeaderLock {
+	timeout := time.Duration(s.Zk.SessionTimeout)
+	if timeout == 0 {
+		timeout = DefaultZkSessionTimeout
+	}
+	return &zkLeaderLock{
+		nodes:   s.Zk.Nodes,
+		path:    path.Join(s.Zk.RootPath, "leaders", strings.Replace(sh.Mysql.SourceID(), "/", "_", -1)),
+		timeout: timeout,
+		logger:  sh.Mysql.logger(),
+	}
+}
+
+// zkLeaderLock holds an ephemeral sequential node, so the lock is released when the
+// session of the process holding it ends. Every acquisition uses its own session.
+type zkLeaderLock struct {
+	nodes   []string
+	path    string
+	timeout time.Duration
+	logger  Logger
+
+	conn *zk.Conn
+	lock *zk.Lock
+}
+
+func (l *zkLeaderLock) Acquire(ctx context.Context) (<-chan struct{}, error) {
+	conn, events, err := zk.Connect(l.nodes, l.timeout, zk.WithLogger(zkLogger{logger: l.logger}))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot connect to zookeeper")
+	}
+
+	lost := make(chan struct{})
+	go l.watchSession(events, lost)
+
+	lock := zk.NewLock(conn, l.path, zk.WorldACL(zk.PermAll))
+	locked := make(chan error, 1)
+	go func() { locked <- lock.Lock() }()
+	select {
+	case err = <-locked:
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-lost:
+		err = errors.New("zookeeper session lost")
+	}
+	if err == nil {
+		select {
+		case <-lost:
+			err = errors.New("zookeeper session lost")
+		default:
+		}
+	}
+	if err != nil {
+		// closing the connection also stops a lock that is still waiting.
+		conn.Close()
+		return nil, errors.Wrapf(err, "cannot lock %s", l.path)
+	}
+
+	l.conn, l.lock = conn, lock
+	return lost, nil
+}
+
+// watchSession closes lost once the lock can't be relied on anymore: when the session
+// expired, when it stayed disconnected for the session timeout, after which zookeeper
+// expires it and deletes the lock's node, or when the connection is closed. A session that
+// reconnects in time still holds the lock.
+func (l *zkLeaderLock) watchSession(events <-chan zk.Event, lost chan<- struct{}) {
+	defer close(lost)
+	var timer *time.Timer
+	var expired <-chan time.Time
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if ev.Type != zk.EventSession {
+				continue
+			}
+			switch ev.State {
+			case zk.StateExpired:
+				l.logger.WithField("path", l.path).Warn("Zookeeper session expired")
+				return
+			case zk.StateDisconnected:
+				if timer == nil {
+					l.logger.WithFields(Fields{
+						"path":    l.path,
+						"timeout": l.timeout,
+					}).Warn("Zookeeper session disconnected")
+					timer = time.NewTimer(l.timeout)
+					expired = timer.C
+				}
+			case zk.StateHasSession:
+				if timer != nil {
+					l.logger.WithField("path", l.path).Info("Zookeeper session reconnected")
+					timer.Stop()
+					timer, expired = nil, nil
+				}
+			}
+		case <-expired:
+			l.logger.WithField("path", l.path).Warn("Zookeeper session disconnected for longer than its timeout")
+			return
+		}
+	}
+}
+
+func (l *zkLeaderLock) Release() error {
+	if l.conn == nil {
+		return nil
+	}
+	err := l.lock.Unlock()
+	l.conn.Close()
+	l.conn, l.lock = nil, nil
+	return err
+}
+
+// RunAsLeader calls run whenever the lock is acquired until ctx is done. The context run is
+// given is done once the lock is lost, the lock is released when run returns.
+func (sh *ShardConfig) RunAsLeader(ctx context.Context, lock LeaderLock, run func(ctx context.Context)) {
+	for ctx.Err() == nil {
+		pipelineHealth.setStandby(sh.ID, true)
+		sh.Mysql.logger().WithField("shard", sh.ID).Info("Waiting for leadership")
+		lost, err := lock.Acquire(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			sh.Mysql.logger().WithError(err).WithField("shard", sh.ID).Error("Unable to acquire leadership, retrying")
+			select {
+			case <-time.After(LeaderRetryInterval):
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		sh.Mysql.logger().WithField("shard", sh.ID).Info("Acquired leadership")
+		pipelineHealth.setStandby(sh.ID, false)
+		leader.WithLabelValues(sh.ID).Set(1)
+		term, stop := context.WithCancel(ctx)
+		go func() {
+			select {
+			case <-lost:
+				sh.Mysql.logger().WithField("shard", sh.ID).Warn("Lost leadership, stopping")
+				stop()
+			case <-term.Done():
+			}
+		}()
+		run(term)
+		stop()
+
+		leader.WithLabelValues(sh.ID).Set(0)
+		if err := lock.Release(); err != nil {
+			sh.Mysql.logger().WithError(err).WithField("shard", sh.ID).Warn("Unable to release leadership")
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package binlog
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// fakeElection hands a lock to one of its fakeLeaderLocks at a time, like the zookeeper
+// lock of a shard does to the processes streaming it.
+type fakeElection struct {
+	held chan struct{}
+}
+
+func newFakeElection() *fakeElection {
+	return &fakeElection{held: make(chan struct{}, 1)}
+}
+
+func (e *fakeElection) lock() *fakeLeaderLock {
+	return &fakeLeaderLock{election: e, acquired: make(chan chan struct{}, 10)}
+}
+
+type fakeLeaderLock struct {
+	election *fakeElection
+	// acquired receives the lost channel of every acquisition.
+	acquired chan chan struct{}
+	released int
+}
+
+func (l *fakeLeaderLock) Acquire(ctx context.Context) (<-chan struct{}, error) {
+	select {
+	case l.election.held <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	lost := make(chan struct{})
+	l.acquired <- lost
+	return lost, nil
+}
+
+func (l *fakeLeaderLock) Release() error {
+	l.released++
+	<-l.election.held
+	return nil
+}
+
+// leaderRun records the terms run is called for.
+type leaderRun struct {
+	started chan struct{}
+	stopped chan struct{}
+}
+
+func newLeaderRun() *leaderRun {
+	return &leaderRun{started: make(chan struct{}, 10), stopped: make(chan struct{}, 10)}
+}
+
+func (r *leaderRun) run(ctx context.Context) {
+	r.started <- struct{}{}
+	<-ctx.Done()
+	r.stopped <- struct{}{}
+}
+
+func waitFor(t *testing.T, what string, ch <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+// waitAcquired waits for l to be acquired and returns the channel that loses it.
+func (l *fakeLeaderLock) waitAcquired(t *testing.T) chan struct{} {
+	t.Helper()
+	select {
+	case lost := <-l.acquired:
+		return lost
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the lock to be acquired")
+		return nil
+	}
+}
+
+func TestRunAsLeaderAcquireAndLose(t *testing.T) {
+	sh := &ShardConfig{ID: "election-lose"}
+	lock := newFakeElection().lock()
+	r := newLeaderRun()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		sh.RunAsLeader(ctx, lock, r.run)
+		close(done)
+	}()
+
+	lost := lock.waitAcquired(t)
+	waitFor(t, "run to start", r.started)
+	close(lost)
+	waitFor(t, "run to stop once the lock is lost", r.stopped)
+
+	// the lock is released and acquired again.
+	lock.waitAcquired(t)
+	waitFor(t, "run to start again", r.started)
+	if lock.released != 1 {
+		t.Errorf("lock released %d times, want 1", lock.released)
+	}
+
+	cancel()
+	waitFor(t, "run to stop", r.stopped)
+	waitFor(t, "RunAsLeader to return", done)
+	if lock.released != 2 {
+		t.Errorf("lock released %d times, want 2", lock.released)
+	}
+}
+
+func TestRunAsLeaderStandbyTakesOver(t *testing.T) {
+	election := newFakeElection()
+	sh := &ShardConfig{ID: "election-standby"}
+	leaderLock, standbyLock := election.lock(), election.lock()
+	leaderRun, standbyRun := newLeaderRun(), newLeaderRun()
+
+	leaderCtx, stopLeader := context.WithCancel(context.Background())
+	defer stopLeader()
+	go sh.RunAsLeader(leaderCtx, leaderLock, leaderRun.run)
+	leaderLock.waitAcquired(t)
+	waitFor(t, "the leader to start", leaderRun.started)
+
+	standbyCtx, stopStandby := context.WithCancel(context.Background())
+	defer stopStandby()
+	go sh.RunAsLeader(standbyCtx, standbyLock, standbyRun.run)
+	select {
+	case <-standbyRun.started:
+		t.Fatal("the standby started while the leader holds the lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the leader stops, like a process that is shut down.
+	stopLeader()
+	waitFor(t, "the leader to stop", leaderRun.stopped)
+	standbyLock.waitAcquired(t)
+	waitFor(t, "the standby to start", standbyRun.started)
+}
+
+func TestZkSessionWatch(t *testing.T) {
+	session := func(state zk.State) zk.Event {
+		return zk.Event{Type: zk.EventSession, State: state}
+	}
+	for _, tc := range []struct {
+		name   string
+		events []zk.Event
+		lost   bool
+	}{
+		{name: "connected", events: []zk.Event{session(zk.StateHasSession)}},
+		{
+			name:   "reconnected in time",
+			events: []zk.Event{session(zk.StateHasSession), session(zk.StateDisconnected), session(zk.StateHasSession)},
+		},
+		{
+			name:   "expired",
+			events: []zk.Event{session(zk.StateHasSession), session(zk.StateExpired)},
+			lost:   true,
+		},
+		{
+			name:   "disconnected past the timeout",
+			events: []zk.Event{session(zk.StateHasSession), session(zk.StateDisconnected)},
+			lost:   true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l := &zkLeaderLock{path: "/test/leaders/shard", timeout: 50 * time.Millisecond, logger: defaultLogger}
+			events := make(chan zk.Event, len(tc.events))
+			for _, ev := range tc.events {
+				events <- ev
+			}
+			lost := make(chan struct{})
+			go l.watchSession(events, lost)
+			defer close(events)
+
+			select {
+			case <-lost:
+				if !tc.lost {
+					t.Fatal("lock lost")
+				}
+			case <-time.After(200 * time.Millisecond):
+				if tc.lost {
+					t.Fatal("lock not lost")
+				}
+			}
+		})
+	}
+}
+
+func TestZkSessionWatchClosed(t *testing.T) {
+	l := &zkLeaderLock{timeout: time.Minute, logger: defaultLogger}
+	events := make(chan zk.Event)
+	lost := make(chan struct{})
+	go l.watchSession(events, lost)
+	close(events)
+	waitFor(t, "the lock to be lost", lost)
+}
@@ -0,0 +1,286 @@
+package binlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	kafka "github.com/segmentio/kafka-go"
+	"github.com/shopspring/decimal"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+const (
+	DefaultTopic           = "test"
+	DefaultMaxMessageBytes = 1000000
+)
+
+// TableInfo is the part of a table's schema needed to convert its rows.
+type TableInfo struct {
+	Schema     string   `json:"schema"`
+	Name       string   `json:"name"`
+	Columns    []string `json:"columns"`
+	PrimaryKey []string `json:"primary_key,omitempty"`
+}
+
+func tableInfoOf(t *schema.Table) TableInfo {
+	info := TableInfo{
+		Schema:  t.Schema,
+		Name:    t.Name,
+		Columns: make([]string, len(t.Columns)),
+	}
+	for i, c := range t.Columns {
+		info.Columns[i] = c.Name
+	}
+	for _, i := range t.PKColumns {
+		info.PrimaryKey = append(info.PrimaryKey, t.Columns[i].Name)
+	}
+	return info
+}
+
+// Source is where in the binlog a change was read from.
+type Source struct {
+	// Shard is the id of the shard the binlog belongs to, it is empty for the master.
+	Shard     string    `json:"shard,omitempty"`
+	File      string    `json:"file,omitempty"`
+	Pos       uint32    `json:"pos,omitempty"`
+	Timestamp time.Time `json:"ts,omitempty"`
+	// GTID identifies the transaction, as uuid:sequence on mysql and
+	// domain-server-sequence on mariadb.
+	GTID string `json:"gtid,omitempty"`
+}
+
+// ChangeEvent is the message written to kafka for every changed row. Inserts only have an
+// after image and deletes only have a before image.
+type ChangeEvent struct {
+	Schema     string                 `json:"schema"`
+	Table      string                 `json:"table"`
+	Action     string                 `json:"action"`
+	PrimaryKey []string               `json:"primary_key,omitempty"`
+	Before     map[string]interface{} `json:"before,omitempty"`
+	After      map[string]interface{} `json:"after,omitempty"`
+	Source     Source                 `json:"source"`
+}
+
+// Router picks the topic of a table's events from a template where {schema} and {table}
+// are replaced by the table's schema and name.
+type Router struct {
+	Template string
+}
+
+var validTopic = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,249}$`)
+
+func (r Router) Topic(schema, table string) (string, error) {
+	topic := strings.NewReplacer("{schema}", schema, "{table}", table).Replace(r.Template)
+	if !validTopic.MatchString(topic) {
+		return "", errors.Errorf("invalid topic %q routed from %q for %s.%s", topic, r.Template, schema, table)
+	}
+	return topic, nil
+}
+
+// RowKey is the message key of a table's row, it names the shard and table so that a
+// tombstone, which has no value, can still be attributed to its row.
+type RowKey struct {
+	Shard  string                 `json:"shard,omitempty"`
+	Schema string                 `json:"schema"`
+	Table  string                 `json:"table"`
+	Key    map[string]interface{} `json:"key"`
+}
+
+func (e *ChangeEvent) rowKey() ([]byte, error) {
+	image := e.After
+	if e.Action == canal.DeleteAction {
+		image = e.Before
+	}
+	return rowKey(e.Source.Shard, e.Schema, e.Table, e.PrimaryKey, image)
+}
+
+// rowKey returns nil for tables without a primary key.
+func rowKey(shard, schema, table string, pk []string, image map[string]interface{}) ([]byte, error) {
+	if len(pk) == 0 || image == nil {
+		return nil, nil
+	}
+	key := RowKey{
+		Shard:  shard,
+		Schema: schema,
+		Table:  table,
+		Key:    make(map[string]interface{}, len(pk)),
+	}
+	for _, c := range pk {
+		key.Key[c] = image[c]
+	}
+	return json.Marshal(key)
+}
+
+// ParseRowKey decodes a message key, keeping numbers as json.Number.
+func ParseRowKey(b []byte) (*RowKey, error) {
+	key := &RowKey{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Encoder converts row changes into kafka messages.
+type Encoder struct {
+	Router          Router
+	MaxMessageBytes int
+	// Tombstones follows every delete with a message that has the row's key and no value,
+	// so that log compaction removes the row. Updates that change the primary key are
+	// followed by a tombstone for the old key.
+	Tombstones bool
+}
+
+func (k *kafkaConfig) NewEncoder() *Encoder {
+	e := &Encoder{
+		Router:          Router{Template: k.Topic},
+		MaxMessageBytes: k.MaxMessageBytes,
+		Tombstones:      k.Tombstones,
+	}
+	if e.Router.Template == "" {
+		e.Router.Template = DefaultTopic
+	}
+	if e.MaxMessageBytes == 0 {
+		e.MaxMessageBytes = DefaultMaxMessageBytes
+	}
+	return e
+}
+
+// Encode converts a single row change to its change event followed by any tombstone.
+// before is nil for inserts and after is nil for deletes.
+func (e *Encoder) Encode(t TableInfo, action string, before, after []interface{}, src Source) ([]kafka.Message, error) {
+	topic, err := e.Router.Topic(t.Schema, t.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	ev := ChangeEvent{
+		Schema:     t.Schema,
+		Table:      t.Name,
+		Action:     action,
+		PrimaryKey: t.PrimaryKey,
+		Source:     src,
+	}
+	if ev.Before, err = rowImage(t, before); err != nil {
+		return nil, err
+	}
+	if ev.After, err = rowImage(t, after); err != nil {
+		return nil, err
+	}
+
+	key, err := ev.rowKey()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot serialize row key")
+	}
+	value, err := json.Marshal(ev)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot serialize change event")
+	}
+	if len(value) > e.MaxMessageBytes {
+		return nil, errors.Errorf("change event is %d bytes, over the %d byte limit", len(value), e.MaxMessageBytes)
+	}
+
+	now := time.Now()
+	msgs := []kafka.Message{{
+		Topic: topic,
+		Key:   key,
+		Value: value,
+		Time:  now,
+	}}
+	if !e.Tombstones || key == nil {
+		return msgs, nil
+	}
+
+	switch action {
+	case canal.DeleteAction:
+		msgs = append(msgs, kafka.Message{Topic: topic, Key: key, Time: now})
+	case canal.UpdateAction:
+		oldKey, err := rowKey(ev.Source.Shard, ev.Schema, ev.Table, ev.PrimaryKey, ev.Before)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot serialize row key")
+		}
+		if !bytes.Equal(oldKey, key) {
+			msgs = append(msgs, kafka.Message{Topic: topic, Key: oldKey, Time: now})
+		}
+	}
+	return msgs, nil
+}
+
+// rowPairs splits the rows of an event into before and after images.
+func rowPairs(action string, rows [][]interface{}) (before, after [][]interface{}) {
+	for i := 0; i < len(rows); i++ {
+		switch action {
+		case canal.InsertAction:
+			before, after = append(before, nil), append(after, rows[i])
+		case canal.DeleteAction:
+			before, after = append(before, rows[i]), append(after, nil)
+		case canal.UpdateAction:
+			if i+1 < len(rows) {
+				before, after = append(before, rows[i]), append(after, rows[i+1])
+			}
+			i++
+		}
+	}
+	return before, after
+}
+
+func rowImage(t TableInfo, row []interface{}) (map[string]interface{}, error) {
+	if row == nil {
+		return nil, nil
+	}
+	if len(row) != len(t.Columns) {
+		return nil, errors.Errorf("row has %d values but %s.%s has %d columns", len(row), t.Schema, t.Name, len(t.Columns))
+	}
+	image := make(map[string]interface{}, len(row))
+	for i, v := range row {
+		value, err := jsonValue(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "column %s", t.Columns[i])
+		}
+		image[t.Columns[i]] = value
+	}
+	return image, nil
+}
+
+// jsonValue converts a value decoded from the binlog into one that serializes to json
+// without losing information.
+func jsonValue(v interface{}) (interface{}, error) {
+	switch value := v.(type) {
+	case nil, bool, string, json.Number,
+		int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64:
+		return value, nil
+	case float32:
+		return jsonValue(float64(value))
+	case float64:
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return nil, errors.Errorf("unsupported float %v", value)
+		}
+		return value, nil
+	case []byte:
+		if utf8.Valid(value) {
+			return string(value), nil
+		}
+		// encoding/json writes byte slices as base64.
+		return value, nil
+	case decimal.Decimal:
+		// written as a number without going through a float.
+		return json.Number(value.String()), nil
+	case time.Time:
+		return value.Format(time.RFC3339Nano), nil
+	case fmt.Stringer:
+		// decimals and the binlog's own date and time types.
+		return value.String(), nil
+	default:
+		return nil, errors.Errorf("unsupported type %T", v)
+	}
+}
@@ -1,22 +1,28 @@
 module github.com/highstead/bin-log-poc
 
 require (
-	github.com/BurntSushi/toml v0.3.1 // indirect
+	github.com/BurntSushi/toml v1.1.0 // indirect
+	github.com/Shopify/ejson v1.2.1
 	github.com/Shopify/reportify-query v0.0.0-20181114175215-d0a5fb8dcb19
 	github.com/Shopify/reportify-streams v0.0.0-20181211164110-72160ac42060 // indirect
-	github.com/Shopify/sarama v1.18.0
+	github.com/Shopify/sarama v1.37.2
 	github.com/confluentinc/confluent-kafka-go v0.11.6
+	github.com/dustin/gojson v0.0.0-20160307161227-2e71ec9dd5ad // indirect
 	github.com/go-sql-driver/mysql v1.4.1
 	github.com/juju/errors v0.0.0-20181118221551-089d3ea4e4d5 // indirect
 	github.com/klauspost/cpuid v0.0.0-20180405133222-e7e905edc00e // indirect
 	github.com/klauspost/crc32 v0.0.0-20170628072449-bab58d77464a // indirect
+	github.com/mattn/go-sqlite3 v1.10.0
 	github.com/pingcap/errors v0.11.0 // indirect
-	github.com/pkg/errors v0.8.0
-	github.com/satori/go.uuid v1.2.0 // indirect
-	github.com/segmentio/kafka-go v0.2.2
-	github.com/shopspring/decimal v0.0.0-20180709203117-cd690d0c9e24 // indirect
+	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.13.0
+	github.com/samuel/go-zookeeper v0.0.0-20180130194729-c4fab1ac1bec
+	github.com/satori/go.uuid v1.2.0
+	github.com/segmentio/kafka-go v0.3.0
+	github.com/shopspring/decimal v0.0.0-20180709203117-cd690d0c9e24
 	github.com/siddontang/go v0.0.0-20180604090527-bdc77568d726 // indirect
-	github.com/siddontang/go-log v0.0.0-20180807004314-8d05993dda07 // indirect
-	github.com/siddontang/go-mysql v0.0.0-20190118051307-00086da2c732
-	github.com/sirupsen/logrus v1.2.0
+	github.com/siddontang/go-log v0.0.0-20180807004314-8d05993dda07
+	github.com/siddontang/go-mysql v1.1.0
+	github.com/sirupsen/logrus v1.6.0
+	github.com/xdg-go/scram v1.1.1
 )
@@ -0,0 +1,394 @@
+package binlog
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+const mysqlUUID = "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+
+func TestCheckpointGTIDs(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		cp     Checkpoint
+		want   string
+		flavor string
+		err    bool
+	}{
+		{name: "none", cp: Checkpoint{}},
+		{
+			name:   "mysql",
+			cp:     Checkpoint{GTIDSet: mysqlUUID + ":1-5:7", Flavor: MysqlFlavor},
+			want:   mysqlUUID + ":1-5:7",
+			flavor: MysqlFlavor,
+		},
+		{
+			name:   "mariadb",
+			cp:     Checkpoint{GTIDSet: "0-1-12,1-1-5", Flavor: MariaDBFlavor},
+			want:   "0-1-12,1-1-5",
+			flavor: MariaDBFlavor,
+		},
+		{name: "invalid", cp: Checkpoint{GTIDSet: "0-1-12", Flavor: MysqlFlavor}, err: true},
+		{name: "unknown flavor", cp: Checkpoint{GTIDSet: "0-1-12", Flavor: "postgres"}, err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			set, err := tc.cp.GTIDs()
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", set)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.want == "" {
+				if set != nil {
+					t.Fatalf("expected no set, got %v", set)
+				}
+				return
+			}
+			if !set.Equal(parseGTIDSet(t, tc.flavor, tc.want)) {
+				t.Errorf("got %v, want %s", set, tc.want)
+			}
+			if got := gtidFlavor(set); got != tc.flavor {
+				t.Errorf("got flavor %q, want %q", got, tc.flavor)
+			}
+		})
+	}
+}
+
+// syncRecorder keeps the checkpoint of the handler after every synced position.
+type syncRecorder struct {
+	*kafkaBlogEventHandler
+	checkpoints []Checkpoint
+}
+
+func (r *syncRecorder) OnPosSynced(pos mysql.Position, set mysql.GTIDSet, force bool) error {
+	if err := r.kafkaBlogEventHandler.OnPosSynced(pos, set, force); err != nil {
+		return err
+	}
+	r.checkpoints = append(r.checkpoints, *r.position)
+	return nil
+}
+
+func parseGTIDSet(t *testing.T, flavor, s string) mysql.GTIDSet {
+	set, err := mysql.ParseGTIDSet(flavor, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return set
+}
+
+// sameGTIDs compares sets as strings, a MariaDB set lists its domains in any order.
+func sameGTIDs(t *testing.T, flavor, got, want string) bool {
+	if got == "" || want == "" {
+		return got == want
+	}
+	return parseGTIDSet(t, flavor, got).Equal(parseGTIDSet(t, flavor, want))
+}
+
+// salesSnapshot is the schema of the table the MariaDB archive changes.
+var salesSnapshot = SchemaSnapshot{
+	"sales.sales": &schema.Table{
+		Schema: "sales",
+		Name:   "sales",
+		Columns: []schema.TableColumn{
+			{Name: "id", Type: schema.TYPE_NUMBER},
+			{Name: "note", Type: schema.TYPE_STRING},
+		},
+		PKColumns: []int{0},
+	},
+}
+
+func TestReplayMariaDBGTIDs(t *testing.T) {
+	producer := &fakeCluster{}
+	h := NewKafkaEventHandler(producer, (&kafkaConfig{}).NewEncoder())
+	r := &syncRecorder{kafkaBlogEventHandler: h}
+	start := mysql.Position{Name: "mariadb-bin.000001", Pos: 4}
+	if err := r.OnPosSynced(start, parseGTIDSet(t, MariaDBFlavor, "0-1-10"), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReplayArchive(filepath.Join("testdata", "mariadb"), mysql.Position{}, salesSnapshot, r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.WriteEvents(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		pos  mysql.Position
+		gtid string
+	}{
+		{start, "0-1-10"},
+		// the transactions, the DDL statement and the rotation each sync a position.
+		{mysql.Position{Name: "mariadb-bin.000001", Pos: 461}, "0-1-11"},
+		{mysql.Position{Name: "mariadb-bin.000001", Pos: 579}, "0-1-12"},
+		{mysql.Position{Name: "mariadb-bin.000001", Pos: 798}, "0-1-12,1-1-5"},
+		{mysql.Position{Name: "mariadb-bin.000001", Pos: 1010}, "0-1-13,1-1-5"},
+		{mysql.Position{Name: "mariadb-bin.000002", Pos: 4}, "0-1-13,1-1-5"},
+	}
+	if len(r.checkpoints) != len(want) {
+		t.Fatalf("got %d synced positions, want %d: %+v", len(r.checkpoints), len(want), r.checkpoints)
+	}
+	for i, cp := range r.checkpoints {
+		if cp.Position != want[i].pos {
+			t.Errorf("sync %d: got position %v, want %v", i, cp.Position, want[i].pos)
+		}
+		if !sameGTIDs(t, MariaDBFlavor, cp.GTIDSet, want[i].gtid) || cp.Flavor != MariaDBFlavor {
+			t.Errorf("sync %d: got %s gtid set %q, want %q", i, cp.Flavor, cp.GTIDSet, want[i].gtid)
+		}
+	}
+
+	// every row is stamped with the gtid of its own transaction, whichever domain it is in.
+	events := []struct {
+		id   json.Number
+		pos  uint32
+		gtid string
+	}{
+		{"1", 430, "0-1-11"},
+		{"2", 767, "1-1-5"},
+		{"3", 767, "1-1-5"},
+		{"4", 979, "0-1-13"},
+	}
+	if len(producer.written) != len(events) {
+		t.Fatalf("got %d events, want %d: %v", len(producer.written), len(events), producer.written)
+	}
+	for i, v := range producer.written {
+		var ev ChangeEvent
+		d := json.NewDecoder(strings.NewReader(v))
+		d.UseNumber()
+		if err := d.Decode(&ev); err != nil {
+			t.Fatal(err)
+		}
+		want := events[i]
+		if ev.Action != canal.InsertAction || ev.After["id"] != want.id {
+			t.Errorf("event %d: got %s of %v, want an insert of id %s", i, ev.Action, ev.After, want.id)
+		}
+		if ev.Source.File != "mariadb-bin.000001" || ev.Source.Pos != want.pos || ev.Source.GTID != want.gtid {
+			t.Errorf("event %d: got source %+v, want %d with gtid %s", i, ev.Source, want.pos, want.gtid)
+		}
+	}
+}
+
+func TestMysqlGTIDs(t *testing.T) {
+	h := NewKafkaEventHandler(nil, nil)
+	pos := mysql.Position{Name: "mysql-bin.000003", Pos: 120}
+	if err := h.OnPosSynced(pos, parseGTIDSet(t, MysqlFlavor, mysqlUUID+":1-5"), true); err != nil {
+		t.Fatal(err)
+	}
+
+	// a transaction committed without canal's set.
+	if err := h.OnGTID(parseGTIDSet(t, MysqlFlavor, mysqlUUID+":6")); err != nil {
+		t.Fatal(err)
+	}
+	pos.Pos = 300
+	if err := h.OnPosSynced(pos, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := h.position.GTIDSet, mysqlUUID+":1-6"; got != want || h.position.Flavor != MysqlFlavor {
+		t.Fatalf("got %s gtid set %q, want %q", h.position.Flavor, got, want)
+	}
+
+	// a transaction that doesn't end in a synced position is over once the next starts.
+	if err := h.OnGTID(parseGTIDSet(t, MysqlFlavor, mysqlUUID+":7")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.OnGTID(parseGTIDSet(t, MysqlFlavor, mysqlUUID+":8")); err != nil {
+		t.Fatal(err)
+	}
+	pos.Pos = 500
+	if err := h.OnPosSynced(pos, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := h.position.GTIDSet, mysqlUUID+":1-8"; got != want {
+		t.Fatalf("got gtid set %q, want %q", got, want)
+	}
+
+	// canal's set replaces the one tracked.
+	pos.Pos = 700
+	if err := h.OnPosSynced(pos, parseGTIDSet(t, MysqlFlavor, mysqlUUID+":1-9"), false); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := h.position.GTIDSet, mysqlUUID+":1-9"; got != want {
+		t.Fatalf("got gtid set %q, want %q", got, want)
+	}
+}
+
+func TestRestartDropsUncommittedGTID(t *testing.T) {
+	h := NewKafkaEventHandler(nil, nil)
+	pos := mysql.Position{Name: "mariadb-bin.000001", Pos: 369}
+	if err := h.OnPosSynced(pos, parseGTIDSet(t, MariaDBFlavor, "0-1-11"), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.OnGTID(parseGTIDSet(t, MariaDBFlavor, "0-1-12")); err != nil {
+		t.Fatal(err)
+	}
+
+	cp := h.restart()
+	if cp == nil || cp.Position != pos || cp.GTIDSet != "0-1-11" {
+		t.Fatalf("got restart checkpoint %+v", cp)
+	}
+	// the rotation canal syncs when it restarts doesn't commit the dropped transaction.
+	if err := h.OnPosSynced(mysql.Position{Name: "mariadb-bin.000001", Pos: 369}, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.position.GTIDSet; got != "0-1-11" {
+		t.Fatalf("got gtid set %q after restart", got)
+	}
+}
+
+func TestGTIDEventHandler(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		lookup string
+		err    error
+		want   string
+	}{
+		{name: "found", lookup: "0-1-10", want: "0-1-10"},
+		{name: "unknown position", want: ""},
+		{name: "failed", err: errors.New("connection refused"), want: ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := NewKafkaEventHandler(nil, nil)
+			var lookups []mysql.Position
+			g := &gtidEventHandler{
+				EventHandler: h,
+				logger:       defaultLogger,
+				gtidSetAt: func(pos mysql.Position) (mysql.GTIDSet, error) {
+					lookups = append(lookups, pos)
+					if tc.lookup == "" {
+						return nil, tc.err
+					}
+					return parseGTIDSet(t, MariaDBFlavor, tc.lookup), tc.err
+				},
+			}
+
+			// canal closed before reading anything.
+			if err := g.OnPosSynced(mysql.Position{}, nil, true); err != nil {
+				t.Fatal(err)
+			}
+			dumped := mysql.Position{Name: "mariadb-bin.000001", Pos: 4}
+			if err := g.OnPosSynced(dumped, nil, true); err != nil {
+				t.Fatal(err)
+			}
+			if err := g.OnGTID(parseGTIDSet(t, MariaDBFlavor, "0-1-11")); err != nil {
+				t.Fatal(err)
+			}
+			if err := g.OnPosSynced(mysql.Position{Name: "mariadb-bin.000001", Pos: 369}, nil, false); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(lookups) != 1 || lookups[0] != dumped {
+				t.Fatalf("got lookups %v, want %v", lookups, dumped)
+			}
+			want := ""
+			if tc.want != "" {
+				want = "0-1-11"
+			}
+			if got := h.position.GTIDSet; got != want {
+				t.Fatalf("got gtid set %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// fakeCanal records how runCanal starts it.
+type fakeCanal struct {
+	ctx     context.Context
+	dumped  chan struct{}
+	run     bool
+	pos     *mysql.Position
+	gtidSet mysql.GTIDSet
+}
+
+func newFakeCanal() *fakeCanal {
+	return &fakeCanal{ctx: context.Background(), dumped: make(chan struct{})}
+}
+
+func (c *fakeCanal) Run() error {
+	c.run = true
+	return nil
+}
+
+func (c *fakeCanal) RunFrom(pos mysql.Position) error {
+	c.pos = &pos
+	return nil
+}
+
+func (c *fakeCanal) StartFromGTID(set mysql.GTIDSet) error {
+	c.gtidSet = set
+	return nil
+}
+
+func (c *fakeCanal) Ctx() context.Context          { return c.ctx }
+func (c *fakeCanal) WaitDumpDone() <-chan struct{} { return c.dumped }
+
+func TestRunCanalResumesFromGTIDs(t *testing.T) {
+	for _, tc := range []struct {
+		flavor string
+		set    string
+	}{
+		{MysqlFlavor, mysqlUUID + ":1-9"},
+		{MariaDBFlavor, "0-1-12,1-1-5"},
+	} {
+		t.Run(tc.flavor, func(t *testing.T) {
+			m := &MysqlConfig{Flavor: tc.flavor}
+			c := newFakeCanal()
+			cp := &Checkpoint{
+				Position: mysql.Position{Name: "bin.000001", Pos: 618},
+				GTIDSet:  tc.set,
+				Flavor:   tc.flavor,
+			}
+			if err := m.runCanal(c, "", cp); err != nil {
+				t.Fatal(err)
+			}
+			if c.run || c.pos != nil {
+				t.Fatal("resumed from the position instead of the gtid set")
+			}
+			if c.gtidSet == nil || gtidFlavor(c.gtidSet) != tc.flavor || !c.gtidSet.Equal(parseGTIDSet(t, tc.flavor, tc.set)) {
+				t.Fatalf("started from %v, want %s", c.gtidSet, tc.set)
+			}
+		})
+	}
+}
+
+func TestRunCanalFlavorMismatch(t *testing.T) {
+	m := &MysqlConfig{Flavor: MariaDBFlavor}
+	c := newFakeCanal()
+	cp := &Checkpoint{GTIDSet: mysqlUUID + ":1-9", Flavor: MysqlFlavor}
+	if err := m.runCanal(c, "", cp); err == nil {
+		t.Fatal("expected an error")
+	}
+	if c.run || c.pos != nil || c.gtidSet != nil {
+		t.Fatal("canal was started")
+	}
+}
+
+func TestRunCanalWithoutGTIDs(t *testing.T) {
+	m := &MysqlConfig{}
+	c := newFakeCanal()
+	pos := mysql.Position{Name: "mysql-bin.000003", Pos: 120}
+	if err := m.runCanal(c, "", &Checkpoint{Position: pos}); err != nil {
+		t.Fatal(err)
+	}
+	if c.pos == nil || *c.pos != pos || c.run || c.gtidSet != nil {
+		t.Fatalf("got %+v, want to resume from %v", c, pos)
+	}
+
+	c = newFakeCanal()
+	if err := m.runCanal(c, "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if !c.run {
+		t.Fatal("canal didn't dump without a checkpoint")
+	}
+}
@@ -2,15 +2,15 @@ package binlog
 
 import (
 	"context"
-	"fmt"
+	"encoding/json"
 	"sync"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/segmentio/kafka-go"
 	"github.com/siddontang/go-mysql/canal"
 	"github.com/siddontang/go-mysql/mysql"
 	"github.com/siddontang/go-mysql/replication"
-	log "github.com/sirupsen/logrus"
 )
 
 type EventHandler interface {
@@ -28,7 +28,9 @@ type EventHandler interface {
 	//  OnGTID is generated when a global transaction identifier is created by commiting a transaction
 	OnGTID(gtid mysql.GTIDSet) error
 	// OnPosSynced Use your own way to sync position. When force is true, sync position immediately.
-	OnPosSynced(pos mysql.Position, force bool) error
+	// set is the GTID set at pos, it is nil unless canal was started from a GTID set, read
+	// one from the dump or looked it up on MariaDB.
+	OnPosSynced(pos mysql.Position, set mysql.GTIDSet, force bool) error
 	String() string
 }
 
@@ -40,35 +42,36 @@ type loggerBlogEventHandler struct {
 }
 
 func (h *loggerBlogEventHandler) OnRotate(rotateEvent *replication.RotateEvent) error {
-	log.WithField("event", rotateEvent).Debug("Rotation Event Occured")
+	defaultLogger.WithField("event", rotateEvent).Debug("Rotation Event Occured")
 	return nil
 }
 
 func (h *loggerBlogEventHandler) OnTableChanged(schema string, table string) error {
-	log.WithField("table", table).Debug("schema change", schema)
+	defaultLogger.WithField("table", table).Debug("schema change", schema)
 	return nil
 }
 
 func (h *loggerBlogEventHandler) OnDDL(nextPos mysql.Position, queryEvent *replication.QueryEvent) error {
-	log.WithField("pos", nextPos).Debug(queryEvent)
+	defaultLogger.WithField("pos", nextPos).Debug(queryEvent)
 	return nil
 }
 func (h *loggerBlogEventHandler) OnRow(e *canal.RowsEvent) error {
-	log.WithField("event", e).Debug("Row event")
+	defaultLogger.WithField("event", e).Debug("Row event")
 	return nil
 }
 
 func (h *loggerBlogEventHandler) OnXID(p mysql.Position) error {
-	log.WithField("position", p).Debug("XID Event")
+	defaultLogger.WithField("position", p).Debug("XID Event")
 	return nil
 }
 func (h *loggerBlogEventHandler) OnGTID(id mysql.GTIDSet) error {
-	log.WithField("GTID", id).Debug("GTID Event")
+	defaultLogger.WithField("GTID", id).Debug("GTID Event")
 	return nil
 }
-func (h *loggerBlogEventHandler) OnPosSynced(p mysql.Position, force bool) error {
-	log.WithFields(log.Fields{
+func (h *loggerBlogEventHandler) OnPosSynced(p mysql.Position, set mysql.GTIDSet, force bool) error {
+	defaultLogger.WithFields(Fields{
 		"pos":   p,
+		"gtids": set,
 		"force": force,
 	}).Debug("Position Synced")
 	return nil
@@ -77,48 +80,286 @@ func (h *loggerBlogEventHandler) String() string { return "binlogEventHandler" }
 
 //kafkaBlogEventHandler emits the canal logs over kafka to be processed elsewhere
 type kafkaBlogEventHandler struct {
-	writer *kafka.Writer
-	msgs   []kafka.Message
-	sync   *sync.Mutex
+	producer    Producer
+	encoder     *Encoder
+	deadLetters string
+	msgs        []kafka.Message
+	sync        *sync.Mutex
+
+	// shard is stamped on every event and key, it is empty for the master. Only the rows of
+	// the tables matching tables are streamed.
+	shard  string
+	tables *TableFilter
+	flush  time.Duration
+
+	// file is the binlog file being read, the row events only know their offset in it.
+	file string
+
+	// txn holds the messages of the transaction being read, they are moved to msgs once
+	// canal syncs the position at the end of the transaction.
+	txn         []kafka.Message
+	position    *Checkpoint
+	checkpoints CheckpointStore
+	// synced is the last position read, where the canal restarts from. The transactions
+	// up to skip are not written again when it restarts from an earlier position.
+	synced *Checkpoint
+	skip   *Checkpoint
+
+	// gtids is the set of transactions read up to position and gtid is the transaction
+	// being read, they are only tracked once canal synced a position with a set.
+	flavor string
+	gtids  mysql.GTIDSet
+	gtid   string
+
+	heartbeat *HeartbeatConfig
+	beats     []kafka.Message
+
+	logger Logger
+
+	// mirror buffers the events copied to the aggregate cluster, they are written apart
+	// from the ones to the local cluster.
+	mirror *aggregateMirror
+
+	// writeErrs receives the writes AutoEmit fails once WriteErrors has been called.
+	writeErrs chan error
 }
 
-func NewKafkaEventHandler(config *kafka.WriterConfig) *kafkaBlogEventHandler {
+func NewKafkaEventHandler(producer Producer, encoder *Encoder) *kafkaBlogEventHandler {
 	return &kafkaBlogEventHandler{
-		writer: kafka.NewWriter(*config),
-		sync:   new(sync.Mutex),
+		producer: producer,
+		encoder:  encoder,
+		sync:     new(sync.Mutex),
+		logger:   defaultLogger,
 	}
 }
 
-func (k *kafkaBlogEventHandler) AutoEmit(ctx context.Context, wFreq time.Duration) {
+// EnableDeadLetters sends row changes that can't be converted or routed to topic instead
+// of stopping the pipeline.
+func (k *kafkaBlogEventHandler) EnableDeadLetters(topic string) {
+	k.sync.Lock()
+	defer k.sync.Unlock()
+	k.deadLetters = topic
+}
+
+// SetLogger makes the handler log through l instead of the package's logger. It must be
+// called before AutoEmit.
+func (k *kafkaBlogEventHandler) SetLogger(l Logger) {
+	k.logger = l
+	if k.mirror != nil {
+		k.mirror.logger = l
+	}
+}
+
+// EnableShard stamps the shard's id on every event and key, and labels the handler's
+// metrics with it.
+func (k *kafkaBlogEventHandler) EnableShard(id string) {
+	k.shard = id
+}
+
+// Configure applies the settings that can change while streaming: the routing and
+// encoding of events, the dead letter topic, the flush interval and the shard's tables.
+func (k *kafkaBlogEventHandler) Configure(config *kafkaConfig, shard *ShardConfig) error {
+	tables, err := shard.Tables()
+	if err != nil {
+		return err
+	}
+	k.sync.Lock()
+	defer k.sync.Unlock()
+	k.encoder = config.NewEncoder()
+	k.deadLetters = config.DeadLetterTopic
+	k.tables = tables
+	if config.FlushInterval > 0 {
+		k.flush = time.Duration(config.FlushInterval)
+	}
+	return nil
+}
+
+// EnableHeartbeat routes rows of the heartbeat table to the heartbeat topic instead of the
+// event topic and uses them to measure capture and end to end lag.
+func (k *kafkaBlogEventHandler) EnableHeartbeat(hb *HeartbeatConfig) {
+	k.heartbeat = hb
+}
+
+// EnableAggregate mirrors the events of the topics selected by config to the aggregate
+// cluster through producer. It must be called before AutoEmit.
+func (k *kafkaBlogEventHandler) EnableAggregate(producer Producer, config *aggregateConfig) error {
+	mirror, err := newAggregateMirror(producer, config, k.shard, k.logger)
+	if err != nil {
+		return err
+	}
+	k.mirror = mirror
+	return nil
+}
+
+// EnableAggregateCheckpoints saves the position of the last transaction mirrored to the
+// aggregate cluster in store, so that the events it misses are replayed from there. It
+// must be called after EnableAggregate and before Resume.
+func (k *kafkaBlogEventHandler) EnableAggregateCheckpoints(ctx context.Context, store CheckpointStore) error {
+	cp, err := store.Load(ctx)
+	if err != nil {
+		return err
+	}
+	k.mirror.checkpoints, k.mirror.written = store, cp
+	return nil
+}
+
+// EnableCheckpoints saves the position of the last transaction written to kafka after
+// every write, so that the pipeline can resume from it.
+func (k *kafkaBlogEventHandler) EnableCheckpoints(store CheckpointStore) {
+	k.checkpoints = store
+}
+
+// write sends msgs to kafka and records how it went.
+func write(ctx context.Context, p Producer, msgs []kafka.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	start := time.Now()
+	err := p.WriteMessages(ctx, msgs...)
+	observeWrite(LocalCluster, start, msgs, err)
+	return err
+}
+
+// WriteErrors returns a channel receiving the error of the writes AutoEmit fails. The
+// events of a failed write are kept and written again on the next try.
+func (k *kafkaBlogEventHandler) WriteErrors() <-chan error {
+	k.sync.Lock()
+	defer k.sync.Unlock()
+	if k.writeErrs == nil {
+		k.writeErrs = make(chan error, 1)
+	}
+	return k.writeErrs
+}
+
+// AutoEmit writes the buffered events every wFreq, or every flush interval once one has
+// been configured. The returned channel is closed once it has stopped writing after ctx
+// is done.
+func (k *kafkaBlogEventHandler) AutoEmit(ctx context.Context, wFreq time.Duration) <-chan struct{} {
+	k.sync.Lock()
+	if k.flush == 0 {
+		k.flush = wFreq
+	}
+	k.sync.Unlock()
+	if k.mirror != nil {
+		go k.mirror.run(ctx, func() time.Duration {
+			k.sync.Lock()
+			defer k.sync.Unlock()
+			return k.flush
+		})
+	}
+	stopped := make(chan struct{})
 	go func() {
-		log.Println("Emitting events")
+		defer close(stopped)
+		k.logger.Info("Emitting events")
 		for {
+			k.sync.Lock()
+			wFreq, errs := k.flush, k.writeErrs
+			k.sync.Unlock()
 			select {
 			case <-time.After(wFreq):
-				k.WriteEvents(ctx)
+				_, err := k.WriteEvents(ctx)
+				if err == nil || ctx.Err() != nil {
+					continue
+				}
+				k.logger.WithError(err).WithField("shard", k.shard).Warn("Unable to write events")
+				select {
+				case errs <- err:
+				default:
+				}
 			case <-ctx.Done():
-				log.Info("Stopping kafka auto commiting")
+				k.logger.Info("Stopping kafka auto commiting")
 				return
 			}
 		}
 	}()
+	return stopped
 }
 
 func (k *kafkaBlogEventHandler) WriteEvents(c context.Context) ([]kafka.Message, error) {
-	log.Println("Writing events", len(k.msgs))
+	k.logger.Info("Writing events", len(k.msgs))
 	ctx, cancel := context.WithTimeout(c, 10*time.Second)
 	defer cancel()
 	k.sync.Lock()
-	msgs := k.msgs
-	k.msgs = nil
+	msgs, beats, pos := k.msgs, k.beats, k.position
+	k.msgs, k.beats, k.position = nil, nil, nil
+	bufferDepth.WithLabelValues(k.shard).Set(float64(len(k.txn)))
 	k.sync.Unlock()
-	err := k.writer.WriteMessages(ctx, msgs...)
-	return msgs, err
+
+	if cp, ok, err := k.transactionalCheckpoint(pos); err != nil || ok {
+		// the events and the checkpoint after them are committed or aborted together.
+		if err == nil {
+			err = write(ctx, k.producer, append(msgs[:len(msgs):len(msgs)], cp))
+		}
+		if err != nil {
+			k.requeue(msgs, beats, pos)
+			return msgs, err
+		}
+		return msgs, k.writeHeartbeats(ctx, beats)
+	}
+
+	if err := write(ctx, k.producer, msgs); err != nil {
+		k.requeue(msgs, beats, pos)
+		return msgs, err
+	}
+	if err := k.checkpoint(ctx, pos); err != nil {
+		k.requeue(nil, nil, pos)
+		return msgs, err
+	}
+	return msgs, k.writeHeartbeats(ctx, beats)
+}
+
+// transactionalCheckpoint returns the message saving cp when the producer writes
+// transactions to the checkpoint store's cluster, ok is false otherwise.
+func (k *kafkaBlogEventHandler) transactionalCheckpoint(cp *Checkpoint) (msg kafka.Message, ok bool, err error) {
+	store, isKafka := k.checkpoints.(*kafkaCheckpointStore)
+	if _, isTxn := k.producer.(*transactionalProducer); !isTxn || !isKafka || cp == nil {
+		return kafka.Message{}, false, nil
+	}
+	cp.Time = time.Now()
+	msg, err = store.message(cp)
+	return msg, true, err
+}
+
+// requeue puts messages that failed to be written back in front of the buffered ones so
+// they are retried in order on the next write.
+func (k *kafkaBlogEventHandler) requeue(msgs, beats []kafka.Message, pos *Checkpoint) {
+	k.sync.Lock()
+	defer k.sync.Unlock()
+	k.msgs = append(msgs, k.msgs...)
+	k.beats = append(beats, k.beats...)
+	if k.position == nil {
+		k.position = pos
+	}
+	bufferDepth.WithLabelValues(k.shard).Set(float64(len(k.msgs) + len(k.txn)))
+}
+
+func (k *kafkaBlogEventHandler) checkpoint(ctx context.Context, cp *Checkpoint) error {
+	if k.checkpoints == nil || cp == nil {
+		return nil
+	}
+	cp.Time = time.Now()
+	return k.checkpoints.Save(ctx, cp)
+}
+
+// writeHeartbeats is called after the events captured with the heartbeats have been
+// written so that the end to end lag covers the whole pipeline.
+func (k *kafkaBlogEventHandler) writeHeartbeats(ctx context.Context, beats []kafka.Message) error {
+	if len(beats) == 0 {
+		return nil
+	}
+	if err := write(ctx, k.producer, beats); err != nil {
+		return err
+	}
+	endToEndLag.WithLabelValues(k.shard).Set(time.Since(beats[len(beats)-1].Time).Seconds())
+	return nil
 }
 
 // OnRotate occurs when the binary file is rotated because the previous file has filled up.
-func (kafkaBlogEventHandler) OnRotate(rotateEvent *replication.RotateEvent) error {
-	log.WithField("event", rotateEvent).Debug("Rotation Event Occured")
+func (k *kafkaBlogEventHandler) OnRotate(rotateEvent *replication.RotateEvent) error {
+	k.logger.WithField("event", rotateEvent).Debug("Rotation Event Occured")
+	k.sync.Lock()
+	defer k.sync.Unlock()
+	k.file = string(rotateEvent.NextLogName)
 	return nil
 }
 
@@ -135,14 +376,82 @@ func (k *kafkaBlogEventHandler) OnDDL(nextPos mysql.Position, queryEvent *replic
 
 //OnRow (??) occurs as granular events between XIDEvents and isnt necessarily synced
 func (k *kafkaBlogEventHandler) OnRow(e *canal.RowsEvent) error {
-	msg := kafka.Message{
-		Key:   []byte(`shard:GTID`),
-		Value: []byte(fmt.Sprintf("%s %v", e.Action, e.Rows)),
-		Time:  time.Now(),
+	if k.heartbeat != nil && k.heartbeat.matches(e.Table.Schema, e.Table.Name) {
+		return k.onHeartbeat(e)
 	}
+
 	k.sync.Lock()
 	defer k.sync.Unlock()
-	k.msgs = append(k.msgs, msg)
+	if !k.tables.Match(e.Table.Schema, e.Table.Name) {
+		return nil
+	}
+
+	src := Source{Shard: k.shard, File: k.file, GTID: k.gtid}
+	if e.Header != nil {
+		src.Pos = e.Header.LogPos
+		src.Timestamp = time.Unix(int64(e.Header.Timestamp), 0)
+	}
+
+	table := tableInfoOf(e.Table)
+	befores, afters := rowPairs(e.Action, e.Rows)
+	msgs := make([]kafka.Message, 0, len(afters))
+	// dead letters stay on the local cluster.
+	var mirrored []kafka.Message
+	for i := range afters {
+		converted, err := k.encoder.Encode(table, e.Action, befores[i], afters[i], src)
+		if err != nil {
+			if k.deadLetters == "" {
+				return errors.Wrapf(err, "cannot convert %s of %s.%s", e.Action, table.Schema, table.Name)
+			}
+			k.logger.WithError(err).WithField("table", table.Name).Warn("Sending row to the dead letter topic")
+			msg, err := deadLetterMessage(k.deadLetters, err, table, e.Action, befores[i], afters[i], src)
+			if err != nil {
+				return err
+			}
+			msgs = append(msgs, msg)
+			continue
+		}
+		msgs = append(msgs, converted...)
+		mirrored = append(mirrored, converted...)
+	}
+	if k.mirror != nil {
+		k.mirror.mirror(mirrored, table, e.Header != nil)
+	}
+
+	// rows from the initial dump are not part of a binlog transaction.
+	if e.Header == nil {
+		k.msgs = append(k.msgs, msgs...)
+	} else {
+		k.txn = append(k.txn, msgs...)
+	}
+	bufferDepth.WithLabelValues(k.shard).Set(float64(len(k.msgs) + len(k.txn)))
+	return nil
+}
+
+func (k *kafkaBlogEventHandler) onHeartbeat(e *canal.RowsEvent) error {
+	beats, err := heartbeats(e, time.Now())
+	if err != nil {
+		return err
+	}
+
+	msgs := make([]kafka.Message, 0, len(beats))
+	for _, beat := range beats {
+		value, err := json.Marshal(beat)
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, kafka.Message{
+			Topic: k.heartbeat.Topic,
+			Key:   []byte(beat.ID),
+			Value: value,
+			Time:  beat.WrittenAt,
+		})
+		captureLag.WithLabelValues(k.shard).Set(beat.CapturedAt.Sub(beat.WrittenAt).Seconds())
+	}
+
+	k.sync.Lock()
+	defer k.sync.Unlock()
+	k.beats = append(k.beats, msgs...)
 	return nil
 }
 
@@ -155,14 +464,125 @@ func (k *kafkaBlogEventHandler) OnXID(nextPos mysql.Position) error {
 
 //  OnGTID is generated when a global transaction identifier is created by commiting a transaction
 func (k *kafkaBlogEventHandler) OnGTID(gtid mysql.GTIDSet) error {
+	k.sync.Lock()
+	defer k.sync.Unlock()
+	// a transaction that didn't end with a synced position, like a statement on a
+	// non-transactional table, is over once the next one starts.
+	if err := k.commitGTID(); err != nil {
+		return err
+	}
+	k.gtid = gtid.String()
+	return nil
+}
 
+func (k *kafkaBlogEventHandler) commitGTID() error {
+	if k.gtids == nil || k.gtid == "" {
+		return nil
+	}
+	if err := k.gtids.Update(k.gtid); err != nil {
+		return errors.Wrapf(err, "cannot add gtid %s", k.gtid)
+	}
+	k.gtid = ""
 	return nil
 }
 
 // OnPosSynced Use your own way to sync position. When force is true, sync position immediately.
-func (k *kafkaBlogEventHandler) OnPosSynced(pos mysql.Position, force bool) error {
+func (k *kafkaBlogEventHandler) OnPosSynced(pos mysql.Position, set mysql.GTIDSet, force bool) error {
+	k.sync.Lock()
+	replay := k.mirror != nil && k.skip != nil
+	k.sync.Unlock()
+	if replay {
+		// the local cluster is caught up while it skips, the replay waits for the
+		// aggregate one instead of filling its buffer up again.
+		k.mirror.waitForRoom()
+	}
+
+	k.sync.Lock()
+	defer k.sync.Unlock()
+	if pos.Name == "" {
+		// a canal that is closed before it read anything syncs an empty position.
+		return nil
+	}
+	if k.mirror != nil && k.mirror.replaying() {
+		return errReplayAggregate
+	}
+	if err := k.commitGTID(); err != nil {
+		return err
+	}
+	if set != nil {
+		// canal's set is the one it resumes from, it is tracked from here on when canal
+		// doesn't track it itself.
+		k.gtids, k.flavor = set.Clone(), gtidFlavor(set)
+	}
+	cp := &Checkpoint{Position: pos}
+	if k.gtids != nil {
+		cp.GTIDSet, cp.Flavor = k.gtids.String(), k.flavor
+	}
+	k.file = pos.Name
+	if k.mirror != nil {
+		mirrored := *cp
+		k.mirror.commit(&mirrored)
+	}
+	if k.skip != nil {
+		if !cp.after(k.skip) {
+			// the canal restarted before the local checkpoint for the aggregate cluster.
+			k.txn = nil
+			return nil
+		}
+		k.skip = nil
+	}
+
+	k.msgs = append(k.msgs, k.txn...)
+	k.txn = nil
+	k.position = cp
+	synced := *k.position
+	k.synced = &synced
 	return nil
+}
+
+// errReplayAggregate stops the canal for it to restart from the aggregate cluster's
+// checkpoint.
+var errReplayAggregate = errors.New("aggregate cluster is back, replaying from its checkpoint")
+
+// Resume returns where to start the canal for the handler to resume from cp, the local
+// checkpoint. It is the aggregate cluster's checkpoint when that is before cp, the events
+// up to cp are only mirrored then.
+func (k *kafkaBlogEventHandler) Resume(cp *Checkpoint) *Checkpoint {
+	if cp == nil {
+		return nil
+	}
+	k.sync.Lock()
+	defer k.sync.Unlock()
+	synced := *cp
+	k.synced, k.skip = &synced, &synced
+	if k.mirror == nil {
+		return cp
+	}
+	return earliestCheckpoint(cp, k.mirror.start(cp))
+}
 
+// restart drops the transaction being read, it is read again once the canal restarts from
+// the returned checkpoint. It is nil when no position has been synced yet. The checkpoint
+// is the mirror's when the aggregate cluster is behind, the transactions up to the local
+// one are not written again.
+func (k *kafkaBlogEventHandler) restart() *Checkpoint {
+	k.sync.Lock()
+	defer k.sync.Unlock()
+	k.txn, k.gtid = nil, ""
+	var mirrored *Checkpoint
+	if k.mirror != nil {
+		mirrored = k.mirror.restart()
+	}
+	bufferDepth.WithLabelValues(k.shard).Set(float64(len(k.msgs)))
+	if k.synced == nil {
+		return mirrored
+	}
+	if k.skip == nil {
+		synced := *k.synced
+		k.skip = &synced
+	}
+	cp := *earliestCheckpoint(k.synced, mirrored)
+	return &cp
 }
 func (kafkaBlogEventHandler) String() string {
 	return "kafkaBlogEventHandler"
@@ -0,0 +1,241 @@
+package binlog
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+// LivenessThreshold is how long the pipeline may go without seeing a binlog event or
+// heartbeat before /healthz reports it as unhealthy.
+var LivenessThreshold = time.Minute
+
+// pipelineHealth is shared by everything running in the process, the same way the
+// prometheus metrics are. Sources are tracked by shard id, the master has none.
+var pipelineHealth = &health{started: time.Now(), shards: make(map[string]*shardHealth)}
+
+type health struct {
+	sync.Mutex
+	started      time.Time
+	shards       map[string]*shardHealth
+	kafkaErr     error
+	aggregateErr error
+	lastErr      error
+}
+
+type shardHealth struct {
+	ctx       context.Context
+	lastEvent time.Time
+	position  mysql.Position
+	delay     time.Duration
+	dumping   bool
+	err       error
+	// standby is set while another process holds the shard's leadership.
+	standby bool
+}
+
+// HealthStatus is the body of the /healthz and /readyz responses. When more than one
+// shard is streamed, Shards has the status of each of them and the rest is the worst of
+// them.
+type HealthStatus struct {
+	OK                  bool                     `json:"ok"`
+	Problems            []string                 `json:"problems,omitempty"`
+	Position            string                   `json:"position,omitempty"`
+	SecondsBehindMaster float64                  `json:"seconds_behind_master"`
+	LastEvent           time.Time                `json:"last_event,omitempty"`
+	DumpComplete        bool                     `json:"dump_complete"`
+	KafkaOK             bool                     `json:"kafka_ok"`
+	LastError           string                   `json:"last_error,omitempty"`
+	AggregateError      string                   `json:"aggregate_error,omitempty"`
+	Standby             bool                     `json:"standby,omitempty"`
+	Shards              map[string]*HealthStatus `json:"shards,omitempty"`
+}
+
+// shard must be called with the lock held.
+func (h *health) shard(id string) *shardHealth {
+	s, ok := h.shards[id]
+	if !ok {
+		s = &shardHealth{}
+		h.shards[id] = s
+	}
+	return s
+}
+
+func (h *health) watch(shard string, ctx context.Context) {
+	h.Lock()
+	defer h.Unlock()
+	h.shard(shard).ctx = ctx
+}
+
+func (h *health) event(shard string) {
+	h.Lock()
+	defer h.Unlock()
+	h.shard(shard).lastEvent = time.Now()
+}
+
+func (h *health) setPosition(shard string, pos mysql.Position) {
+	h.Lock()
+	defer h.Unlock()
+	h.shard(shard).position = pos
+}
+
+func (h *health) setDelay(shard string, d time.Duration) {
+	h.Lock()
+	defer h.Unlock()
+	h.shard(shard).delay = d
+}
+
+func (h *health) setDumping(shard string, dumping bool) {
+	h.Lock()
+	defer h.Unlock()
+	h.shard(shard).dumping = dumping
+}
+
+func (h *health) setStandby(shard string, standby bool) {
+	h.Lock()
+	defer h.Unlock()
+	h.shard(shard).standby = standby
+}
+
+// kafkaResult records the outcome of a write to a cluster. Only the local cluster affects
+// readiness, the aggregate cluster is mirrored to on a best effort basis.
+func (h *health) kafkaResult(cluster string, err error) {
+	h.Lock()
+	defer h.Unlock()
+	if cluster == AggregateCluster {
+		h.aggregateErr = err
+	} else {
+		h.kafkaErr = err
+	}
+	if err != nil {
+		h.lastErr = err
+	}
+}
+
+func (h *health) setError(shard string, err error) {
+	h.Lock()
+	defer h.Unlock()
+	h.shard(shard).err = err
+	h.lastErr = err
+}
+
+// check builds the status of every shard with the problems found by problems, and the
+// overall status from them.
+func (h *health) check(problems func(s *shardHealth, status *HealthStatus)) HealthStatus {
+	h.Lock()
+	defer h.Unlock()
+
+	all := HealthStatus{
+		DumpComplete: true,
+		KafkaOK:      h.kafkaErr == nil,
+		Shards:       make(map[string]*HealthStatus, len(h.shards)),
+	}
+	if h.lastErr != nil {
+		all.LastError = h.lastErr.Error()
+	}
+	if h.aggregateErr != nil {
+		all.AggregateError = h.aggregateErr.Error()
+	}
+	shards := h.shards
+	if len(shards) == 0 {
+		// nothing has been read yet.
+		shards = map[string]*shardHealth{"": {}}
+	}
+	for id, s := range shards {
+		status := &HealthStatus{
+			SecondsBehindMaster: s.delay.Seconds(),
+			LastEvent:           s.lastEvent,
+			DumpComplete:        !s.dumping,
+			KafkaOK:             all.KafkaOK,
+			Standby:             s.standby,
+		}
+		if s.position.Name != "" {
+			status.Position = s.position.String()
+		}
+		if s.err != nil {
+			status.LastError = s.err.Error()
+		}
+		problems(s, status)
+		status.OK = len(status.Problems) == 0
+		all.Shards[id] = status
+
+		for _, p := range status.Problems {
+			if id != "" {
+				p = id + ": " + p
+			}
+			all.Problems = append(all.Problems, p)
+		}
+		if status.SecondsBehindMaster > all.SecondsBehindMaster {
+			all.SecondsBehindMaster = status.SecondsBehindMaster
+		}
+		if !status.LastEvent.IsZero() && (all.LastEvent.IsZero() || status.LastEvent.Before(all.LastEvent)) {
+			all.LastEvent = status.LastEvent
+		}
+		all.DumpComplete = all.DumpComplete && status.DumpComplete
+		all.Position = status.Position
+	}
+	if len(all.Shards) > 1 {
+		all.Position = ""
+	} else {
+		all.Shards = nil
+	}
+	return all
+}
+
+// liveness fails once a canal has stopped or nothing has been read from a binlog within
+// the LivenessThreshold. Shards on standby are not streamed so they are always live, and so
+// are processes that don't read a binlog at all.
+func (h *health) liveness() HealthStatus {
+	h.Lock()
+	streaming := len(h.shards) > 0
+	h.Unlock()
+	s := h.check(func(s *shardHealth, status *HealthStatus) {
+		if s.standby || !streaming {
+			return
+		}
+		if s.ctx != nil && s.ctx.Err() != nil {
+			status.Problems = append(status.Problems, "canal stopped: "+s.ctx.Err().Error())
+		}
+		last := s.lastEvent
+		if last.IsZero() {
+			last = h.started
+		}
+		if time.Since(last) > LivenessThreshold {
+			status.Problems = append(status.Problems, "no binlog events since "+last.Format(time.RFC3339))
+		}
+	})
+	s.OK = len(s.Problems) == 0
+	return s
+}
+
+// readiness fails until the initial dumps are complete and while kafka writes are failing.
+func (h *health) readiness() HealthStatus {
+	s := h.check(func(s *shardHealth, status *HealthStatus) {
+		if s.dumping {
+			status.Problems = append(status.Problems, "initial dump in progress")
+		}
+	})
+	h.Lock()
+	kafkaErr := h.kafkaErr
+	h.Unlock()
+	if kafkaErr != nil {
+		s.Problems = append(s.Problems, "kafka writes failing: "+kafkaErr.Error())
+	}
+	s.OK = len(s.Problems) == 0
+	return s
+}
+
+func healthHandler(check func() HealthStatus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := check()
+		w.Header().Set("Content-Type", "application/json")
+		if !s.OK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(s)
+	}
+}
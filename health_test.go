@@ -0,0 +1,23 @@
+package binlog
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLivenessWithoutBinlog(t *testing.T) {
+	h := &health{started: time.Now().Add(-2 * LivenessThreshold), shards: make(map[string]*shardHealth)}
+	if s := h.liveness(); !s.OK {
+		t.Fatalf("process without a canal is not live: %v", s.Problems)
+	}
+
+	h.watch("", context.Background())
+	if s := h.liveness(); s.OK {
+		t.Fatal("canal that never read an event is live")
+	}
+	h.event("")
+	if s := h.liveness(); !s.OK {
+		t.Fatalf("canal that just read an event is not live: %v", s.Problems)
+	}
+}
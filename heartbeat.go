@@ -0,0 +1,140 @@
+package binlog
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/siddontang/go-mysql/canal"
+)
+
+const (
+	DefaultHeartbeatTable  = "binlog_heartbeat"
+	DefaultHeartbeatTopic  = "binlog_heartbeat"
+	DefaultHeartbeatPeriod = time.Second
+)
+
+// HeartbeatConfig describes the table a HeartbeatWriter stamps and the topic the stamps
+// are published to once they come back through the binlog.
+type HeartbeatConfig struct {
+	Enabled bool     `json:"_enabled,omitempty"`
+	Schema  string   `json:"_schema,omitempty"`
+	Table   string   `json:"_table,omitempty"`
+	Topic   string   `json:"_topic,omitempty"`
+	Period  Duration `json:"_period,omitempty"`
+}
+
+func (h *HeartbeatConfig) setDefaults(m *MysqlConfig) {
+	if h.Schema == "" {
+		h.Schema = m.DB
+	}
+	if h.Table == "" {
+		h.Table = DefaultHeartbeatTable
+	}
+	if h.Topic == "" {
+		h.Topic = DefaultHeartbeatTopic
+	}
+	if h.Period == 0 {
+		h.Period = Duration(DefaultHeartbeatPeriod)
+	}
+}
+
+func (h *HeartbeatConfig) matches(schema, table string) bool {
+	return h.Schema == schema && h.Table == table
+}
+
+// Heartbeat is the message published to the heartbeat topic.
+type Heartbeat struct {
+	ID         string    `json:"id"`
+	WrittenAt  time.Time `json:"written_at"`
+	CapturedAt time.Time `json:"captured_at"`
+}
+
+// HeartbeatWriter periodically updates a row in the heartbeat table so that quiet shards
+// still produce binlog events that can be followed through the pipeline.
+type HeartbeatWriter struct {
+	config *HeartbeatConfig
+	db     *sql.DB
+	id     string
+	logger Logger
+}
+
+func (m *MysqlConfig) NewHeartbeatWriter(config *HeartbeatConfig) (*HeartbeatWriter, error) {
+	config.setDefaults(m)
+	db, err := m.Connect()
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%s`.`%s` (`id` VARCHAR(255) NOT NULL, `ts` BIGINT NOT NULL, PRIMARY KEY (`id`))",
+		config.Schema, config.Table)
+	if _, err := db.Exec(query); err != nil {
+		db.Close()
+		return nil, errors.Wrapf(err, "cannot create heartbeat table %s.%s", config.Schema, config.Table)
+	}
+
+	return &HeartbeatWriter{
+		config: config,
+		db:     db,
+		id:     m.SourceID(),
+		logger: m.logger(),
+	}, nil
+}
+
+func (h *HeartbeatWriter) Run(ctx context.Context) {
+	go func() {
+		h.logger.WithField("table", h.config.Table).Info("Writing heartbeats")
+		defer h.db.Close()
+		for {
+			select {
+			case <-time.After(time.Duration(h.config.Period)):
+				if err := h.Beat(ctx); err != nil {
+					h.logger.WithError(err).Warn("unable to write heartbeat")
+				}
+			case <-ctx.Done():
+				h.logger.Info("Stopping heartbeat writer")
+				return
+			}
+		}
+	}()
+}
+
+func (h *HeartbeatWriter) Beat(ctx context.Context) error {
+	query := fmt.Sprintf("INSERT INTO `%s`.`%s` (`id`, `ts`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `ts` = VALUES(`ts`)",
+		h.config.Schema, h.config.Table)
+	_, err := h.db.ExecContext(ctx, query, h.id, time.Now().UnixNano())
+	return err
+}
+
+// heartbeats extracts the heartbeats written by a HeartbeatWriter from a row event.
+func heartbeats(e *canal.RowsEvent, capturedAt time.Time) ([]Heartbeat, error) {
+	if e.Action == canal.DeleteAction {
+		return nil, nil
+	}
+
+	idCol, tsCol := e.Table.FindColumn("id"), e.Table.FindColumn("ts")
+	if idCol < 0 || tsCol < 0 {
+		return nil, errors.Errorf("heartbeat table %s.%s is missing id or ts", e.Table.Schema, e.Table.Name)
+	}
+
+	var beats []Heartbeat
+	for i, row := range e.Rows {
+		// update events are emitted as before and after image pairs, only the after image is interesting.
+		if e.Action == canal.UpdateAction && i%2 == 0 {
+			continue
+		}
+
+		ts, ok := row[tsCol].(int64)
+		if !ok {
+			return nil, errors.Errorf("unexpected heartbeat timestamp %T", row[tsCol])
+		}
+		beats = append(beats, Heartbeat{
+			ID:         fmt.Sprint(row[idCol]),
+			WrittenAt:  time.Unix(0, ts),
+			CapturedAt: capturedAt,
+		})
+	}
+	return beats, nil
+}
@@ -0,0 +1,198 @@
+package binlog
+
+import (
+	"fmt"
+	stdlog "log"
+	"regexp"
+	"sort"
+	"strings"
+
+	golog "github.com/siddontang/go-log/log"
+	"github.com/sirupsen/logrus"
+)
+
+// Fields are the structured context of a log entry.
+type Fields map[string]interface{}
+
+// Logger is what the package logs through. The handlers and mysql configs take one, the
+// rest of the package and go-mysql log through the one set with SetLogger.
+type Logger interface {
+	WithField(key string, value interface{}) Logger
+	WithFields(fields Fields) Logger
+	WithError(err error) Logger
+
+	Debug(args ...interface{})
+	Info(args ...interface{})
+	Warn(args ...interface{})
+	Error(args ...interface{})
+	// Panic logs at error level and panics with the message.
+	Panic(args ...interface{})
+}
+
+// defaultLogger is used wherever no logger was injected, it logs through the standard
+// logrus logger until SetLogger is called.
+var defaultLogger Logger = NewLogrusLogger(logrus.StandardLogger())
+
+func init() {
+	routeGoMysql(defaultLogger)
+}
+
+// SetLogger makes l the logger of everything in the package that wasn't given one, and of
+// go-mysql's canal and syncer. It should be called before streaming starts.
+func SetLogger(l Logger) {
+	defaultLogger = l
+	routeGoMysql(l)
+}
+
+// routeGoMysql replaces go-mysql's global logger with one writing to l. go-mysql only
+// formats lines, so their level is read back from the prefix.
+func routeGoMysql(l Logger) {
+	logger := golog.New(goMysqlHandler{logger: l.WithField("component", "go-mysql")}, golog.Llevel)
+	logger.SetLevel(golog.LevelDebug)
+	golog.SetDefaultLogger(logger)
+}
+
+type goMysqlHandler struct {
+	logger Logger
+}
+
+func (h goMysqlHandler) Write(b []byte) (int, error) {
+	line := strings.TrimSuffix(string(b), "\n")
+	level := ""
+	if strings.HasPrefix(line, "[") {
+		if i := strings.Index(line, "] "); i > 0 {
+			level, line = line[1:i], line[i+2:]
+		}
+	}
+	// canal logs the mysqldump command line, password included.
+	line = ScrubDSN(line)
+
+	switch level {
+	case "trace", "debug":
+		h.logger.Debug(line)
+	case "warn":
+		h.logger.Warn(line)
+	case "error", "fatal":
+		h.logger.Error(line)
+	default:
+		h.logger.Info(line)
+	}
+	return len(b), nil
+}
+
+func (goMysqlHandler) Close() error { return nil }
+
+// zkLogger adapts a Logger to the Printf logging of the zookeeper client.
+type zkLogger struct {
+	logger Logger
+}
+
+func (l zkLogger) Printf(format string, args ...interface{}) {
+	l.logger.Info(ScrubDSN(fmt.Sprintf(format, args...)))
+}
+
+var (
+	dsnCredentials  = regexp.MustCompile(`([a-zA-Z][\w+.-]*://)?([^\s:@/()]+):(\S*)@`)
+	flagCredentials = regexp.MustCompile(`(--password=|[?&;]password=)[^\s&;]*`)
+)
+
+const scrubbed = "xxxxx"
+
+// ScrubDSN hides the passwords of the DSNs in s, in the user:password@ form of the mysql
+// driver and of URLs, along with password flags and query parameters.
+func ScrubDSN(s string) string {
+	s = dsnCredentials.ReplaceAllString(s, "${1}${2}:"+scrubbed+"@")
+	return flagCredentials.ReplaceAllString(s, "${1}"+scrubbed)
+}
+
+// NewLogrusLogger logs through l, which keeps its own level and formatter.
+func NewLogrusLogger(l *logrus.Logger) Logger {
+	return logrusLogger{entry: logrus.NewEntry(l)}
+}
+
+type logrusLogger struct {
+	entry *logrus.Entry
+}
+
+func (l logrusLogger) WithField(key string, value interface{}) Logger {
+	return logrusLogger{entry: l.entry.WithField(key, value)}
+}
+
+func (l logrusLogger) WithFields(fields Fields) Logger {
+	return logrusLogger{entry: l.entry.WithFields(logrus.Fields(fields))}
+}
+
+func (l logrusLogger) WithError(err error) Logger {
+	return logrusLogger{entry: l.entry.WithError(err)}
+}
+
+func (l logrusLogger) Debug(args ...interface{}) { l.entry.Debug(args...) }
+func (l logrusLogger) Info(args ...interface{})  { l.entry.Info(args...) }
+func (l logrusLogger) Warn(args ...interface{})  { l.entry.Warn(args...) }
+func (l logrusLogger) Error(args ...interface{}) { l.entry.Error(args...) }
+func (l logrusLogger) Panic(args ...interface{}) { l.entry.Panic(args...) }
+
+// NewStdLogger logs through a standard library logger, one line per entry with the
+// level first and the fields as sorted key=value pairs after the message. Debug entries
+// are dropped unless debug is set.
+func NewStdLogger(l *stdlog.Logger, debug bool) Logger {
+	return &stdLogger{logger: l, debug: debug}
+}
+
+type stdLogger struct {
+	logger *stdlog.Logger
+	debug  bool
+	fields Fields
+}
+
+func (l *stdLogger) WithField(key string, value interface{}) Logger {
+	return l.WithFields(Fields{key: value})
+}
+
+func (l *stdLogger) WithFields(fields Fields) Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &stdLogger{logger: l.logger, debug: l.debug, fields: merged}
+}
+
+func (l *stdLogger) WithError(err error) Logger {
+	return l.WithField("error", err)
+}
+
+func (l *stdLogger) Debug(args ...interface{}) {
+	if l.debug {
+		l.output("debug", args)
+	}
+}
+
+func (l *stdLogger) Info(args ...interface{})  { l.output("info", args) }
+func (l *stdLogger) Warn(args ...interface{})  { l.output("warn", args) }
+func (l *stdLogger) Error(args ...interface{}) { l.output("error", args) }
+
+func (l *stdLogger) Panic(args ...interface{}) {
+	l.output("error", args)
+	panic(fmt.Sprint(args...))
+}
+
+func (l *stdLogger) output(level string, args []interface{}) {
+	var b strings.Builder
+	b.WriteString(level)
+	b.WriteByte(' ')
+	b.WriteString(fmt.Sprint(args...))
+
+	keys := make([]string, 0, len(l.fields))
+	for k := range l.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%v", k, l.fields[k])
+	}
+	// the caller of the level method is reported by Lshortfile.
+	l.logger.Output(3, b.String())
+}
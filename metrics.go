@@ -0,0 +1,302 @@
+package binlog
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	kafka "github.com/segmentio/kafka-go"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+var (
+	captureLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "binlog",
+		Name:      "capture_lag_seconds",
+		Help:      "Time between a heartbeat being written to mysql and it being read from the binlog.",
+	}, []string{"shard"})
+	endToEndLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "binlog",
+		Name:      "end_to_end_lag_seconds",
+		Help:      "Time between a heartbeat being written to mysql and it being written to kafka.",
+	}, []string{"shard"})
+	secondsBehindMaster = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "binlog",
+		Name:      "seconds_behind_master",
+		Help:      "Time between an event being written to the binlog and it being read.",
+	}, []string{"shard"})
+
+	rowEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "binlog",
+		Name:      "row_events_total",
+		Help:      "Row events read from the binlog.",
+	}, []string{"shard", "action", "schema", "table"})
+	rows = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "binlog",
+		Name:      "rows_total",
+		Help:      "Rows read from the binlog.",
+	}, []string{"shard", "action", "schema", "table"})
+	ddlEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "binlog",
+		Name:      "ddl_events_total",
+		Help:      "DDL statements read from the binlog.",
+	}, []string{"shard"})
+
+	binlogFile = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "binlog",
+		Name:      "file_sequence",
+		Help:      "Sequence number of the binlog file currently being read.",
+	}, []string{"shard"})
+	binlogPosition = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "binlog",
+		Name:      "position",
+		Help:      "Offset within the binlog file currently being read.",
+	}, []string{"shard"})
+
+	checkpointAge = newCheckpointAges(prometheus.NewDesc(
+		"binlog_checkpoint_age_seconds",
+		"Time since the binlog position was last synced.",
+		[]string{"shard"}, nil,
+	))
+	leader = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "binlog",
+		Name:      "leader",
+		Help:      "Whether this process holds the leadership of the shard and streams it.",
+	}, []string{"shard"})
+	aggregateBufferDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "binlog",
+		Subsystem: "aggregate",
+		Name:      "buffered_messages",
+		Help:      "Messages waiting to be mirrored to the aggregate cluster.",
+	}, []string{"shard"})
+	aggregateDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "binlog",
+		Subsystem: "aggregate",
+		Name:      "dropped_messages_total",
+		Help:      "Messages dropped because the aggregate buffer was full.",
+	}, []string{"shard"})
+	shardRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "binlog",
+		Name:      "shard_restarts_total",
+		Help:      "Times the canal of a shard was restarted after it stopped.",
+	}, []string{"shard"})
+
+	kafkaBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "binlog",
+		Subsystem: "kafka",
+		Name:      "produced_bytes_total",
+		Help:      "Bytes of message keys and values written to kafka.",
+	}, []string{"cluster", "topic"})
+	kafkaMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "binlog",
+		Subsystem: "kafka",
+		Name:      "produced_messages_total",
+		Help:      "Messages written to kafka.",
+	}, []string{"cluster", "topic"})
+	kafkaWriteLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "binlog",
+		Subsystem: "kafka",
+		Name:      "write_duration_seconds",
+		Help:      "Time taken to write a batch of messages to kafka.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 15),
+	}, []string{"cluster", "topic"})
+	kafkaWriteErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "binlog",
+		Subsystem: "kafka",
+		Name:      "write_errors_total",
+		Help:      "Failed batch writes to kafka.",
+	}, []string{"cluster", "topic"})
+	deadLetters = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "binlog",
+		Name:      "dead_letters_total",
+		Help:      "Row changes sent to the dead letter topic because they could not be converted or routed.",
+	}, []string{"shard", "schema", "table"})
+	bufferDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "binlog",
+		Subsystem: "kafka",
+		Name:      "buffered_messages",
+		Help:      "Messages waiting to be written to kafka.",
+	}, []string{"shard"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		captureLag,
+		endToEndLag,
+		secondsBehindMaster,
+		rowEvents,
+		rows,
+		ddlEvents,
+		binlogFile,
+		binlogPosition,
+		checkpointAge,
+		kafkaBytes,
+		kafkaMessages,
+		kafkaWriteLatency,
+		kafkaWriteErrors,
+		deadLetters,
+		bufferDepth,
+		shardRestarts,
+		leader,
+		aggregateBufferDepth,
+		aggregateDropped,
+	)
+}
+
+// ServeMetrics exposes the prometheus metrics on /metrics and the liveness and readiness
+// checks on /healthz and /readyz alongside anything registered on the default mux, such as
+// net/http/pprof.
+func ServeMetrics(addr string) {
+	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/healthz", healthHandler(pipelineHealth.liveness))
+	http.Handle("/readyz", healthHandler(pipelineHealth.readiness))
+	go func() {
+		defaultLogger.WithField("addr", addr).Info("Serving metrics")
+		if err := http.ListenAndServe(addr, nil); err != nil {
+			defaultLogger.WithError(err).Error("metrics server stopped")
+		}
+	}()
+}
+
+// ObserveEvent records the position and delay of an event read directly from a binlog
+// stream.
+func ObserveEvent(ev *replication.BinlogEvent) {
+	pipelineHealth.event("")
+	if ev.Header.Timestamp != 0 {
+		observeDelay("", time.Since(time.Unix(int64(ev.Header.Timestamp), 0)))
+	}
+	if ev.Header.LogPos != 0 {
+		binlogPosition.WithLabelValues("").Set(float64(ev.Header.LogPos))
+	}
+	if rotate, ok := ev.Event.(*replication.RotateEvent); ok {
+		observeFile("", string(rotate.NextLogName))
+	}
+}
+
+func observeDelay(shard string, d time.Duration) {
+	secondsBehindMaster.WithLabelValues(shard).Set(d.Seconds())
+	pipelineHealth.setDelay(shard, d)
+}
+
+// observeWrite records a write to the local or the aggregate cluster.
+func observeWrite(cluster string, start time.Time, msgs []kafka.Message, err error) {
+	pipelineHealth.kafkaResult(cluster, err)
+	took := time.Since(start).Seconds()
+
+	counts := make(map[string]int)
+	sizes := make(map[string]int)
+	for _, m := range msgs {
+		counts[m.Topic]++
+		sizes[m.Topic] += len(m.Key) + len(m.Value)
+	}
+	for topic, count := range counts {
+		kafkaWriteLatency.WithLabelValues(cluster, topic).Observe(took)
+		if err != nil {
+			kafkaWriteErrors.WithLabelValues(cluster, topic).Inc()
+			continue
+		}
+		kafkaMessages.WithLabelValues(cluster, topic).Add(float64(count))
+		kafkaBytes.WithLabelValues(cluster, topic).Add(float64(sizes[topic]))
+	}
+}
+
+var binlogSequence = regexp.MustCompile(`\.(\d+)$`)
+
+func observeFile(shard, name string) {
+	m := binlogSequence.FindStringSubmatch(name)
+	if m == nil {
+		return
+	}
+	if seq, err := strconv.ParseFloat(m[1], 64); err == nil {
+		binlogFile.WithLabelValues(shard).Set(seq)
+	}
+}
+
+func observePosition(shard string, pos mysql.Position) {
+	pipelineHealth.setPosition(shard, pos)
+	observeFile(shard, pos.Name)
+	binlogPosition.WithLabelValues(shard).Set(float64(pos.Pos))
+}
+
+// checkpointAges reports the time since each shard last synced its position.
+type checkpointAges struct {
+	desc *prometheus.Desc
+	sync sync.Mutex
+	last map[string]time.Time
+}
+
+func newCheckpointAges(desc *prometheus.Desc) *checkpointAges {
+	return &checkpointAges{desc: desc, last: make(map[string]time.Time)}
+}
+
+func (c *checkpointAges) synced(shard string) {
+	c.sync.Lock()
+	defer c.sync.Unlock()
+	c.last[shard] = time.Now()
+}
+
+func (c *checkpointAges) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *checkpointAges) Collect(ch chan<- prometheus.Metric) {
+	c.sync.Lock()
+	defer c.sync.Unlock()
+	for shard, last := range c.last {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, time.Since(last).Seconds(), shard)
+	}
+}
+
+// metricsEventHandler records the events of a shard passing through to the wrapped
+// handler.
+type metricsEventHandler struct {
+	EventHandler
+	shard string
+}
+
+func (h metricsEventHandler) OnRotate(rotateEvent *replication.RotateEvent) error {
+	pipelineHealth.event(h.shard)
+	observeFile(h.shard, string(rotateEvent.NextLogName))
+	return h.EventHandler.OnRotate(rotateEvent)
+}
+
+func (h metricsEventHandler) OnDDL(nextPos mysql.Position, queryEvent *replication.QueryEvent) error {
+	pipelineHealth.event(h.shard)
+	ddlEvents.WithLabelValues(h.shard).Inc()
+	return h.EventHandler.OnDDL(nextPos, queryEvent)
+}
+
+func (h metricsEventHandler) OnRow(e *canal.RowsEvent) error {
+	pipelineHealth.event(h.shard)
+	rowEvents.WithLabelValues(h.shard, e.Action, e.Table.Schema, e.Table.Name).Inc()
+	n := len(e.Rows)
+	if e.Action == canal.UpdateAction {
+		n /= 2
+	}
+	rows.WithLabelValues(h.shard, e.Action, e.Table.Schema, e.Table.Name).Add(float64(n))
+	if e.Header != nil && e.Header.Timestamp != 0 {
+		observeDelay(h.shard, time.Since(time.Unix(int64(e.Header.Timestamp), 0)))
+	}
+	return h.EventHandler.OnRow(e)
+}
+
+func (h metricsEventHandler) OnXID(nextPos mysql.Position) error {
+	pipelineHealth.event(h.shard)
+	observePosition(h.shard, nextPos)
+	return h.EventHandler.OnXID(nextPos)
+}
+
+func (h metricsEventHandler) OnPosSynced(pos mysql.Position, set mysql.GTIDSet, force bool) error {
+	observePosition(h.shard, pos)
+	err := h.EventHandler.OnPosSynced(pos, set, force)
+	if err == nil {
+		checkpointAge.synced(h.shard)
+	}
+	return err
+}
@@ -2,18 +2,35 @@ package binlog
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	mysqldriver "github.com/go-sql-driver/mysql"
 	"github.com/pkg/errors"
 	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
 	"github.com/siddontang/go-mysql/replication"
-	log "github.com/sirupsen/logrus"
 )
 
-const DefaultMaxConnections = 100
+const (
+	DefaultMaxConnections = 100
+	DefaultServerID       = 100
+
+	MysqlFlavor   = mysql.MySQLFlavor
+	MariaDBFlavor = mysql.MariaDBFlavor
+)
 
 type MysqlConfig struct {
 	DB             string            `json:"_database,omitempty"`
@@ -28,7 +45,246 @@ type MysqlConfig struct {
 	User           string            `json:"_username,omitempty"`
 	MultiStatement bool              `json:"_multistatement,omitempty"`
 
+	// ServerID identifies the replication client to the server, every client of a server
+	// needs its own. RandomServerID picks one that no replica of the server uses instead.
+	ServerID       uint32 `json:"_server_id,omitempty"`
+	RandomServerID bool   `json:"_random_server_id,omitempty"`
+	// Flavor is mysql or mariadb.
+	Flavor          string   `json:"_flavor,omitempty"`
+	Charset         string   `json:"_charset,omitempty"`
+	HeartbeatPeriod Duration `json:"_heartbeat_period,omitempty"`
+	ReadTimeout     Duration `json:"_read_timeout,omitempty"`
+	SemiSync        bool     `json:"_semi_sync,omitempty"`
+
+	// TLSMode is disabled, skip-verify, verify-ca or verify-full. It defaults to verify-full
+	// when a CA or client certificate is configured and to disabled otherwise. SSL is the
+	// CA trusted in addition to the system roots. SSL, ClientCert and ClientKey are each
+	// either PEM encoded or the path to a PEM file.
+	TLSMode    string `json:"_tls_mode,omitempty"`
+	ClientCert string `json:"client_cert,omitempty"`
+	ClientKey  string `json:"client_key,omitempty"`
+
+	// Logger is what the config's connections, canal and heartbeat writer log through,
+	// the package's logger when it is nil.
+	Logger Logger `json:"-"`
+
+	// tlsConfig is the name tls is registered with the driver under.
 	tlsConfig string
+	tls       *tls.Config
+
+	// randomServerID is the server id picked when RandomServerID is set. It is kept out of
+	// ServerID so that reloaded secrets still compare equal.
+	randomServerID uint32
+}
+
+const (
+	TLSDisabled   = "disabled"
+	TLSSkipVerify = "skip-verify"
+	TLSVerifyCA   = "verify-ca"
+	TLSVerifyFull = "verify-full"
+)
+
+// systemCertDir is where mysqldump finds the system roots when no CA is configured.
+const systemCertDir = "/etc/ssl/certs"
+
+// setupTLS builds the TLS config and registers it with the driver so that both the sql
+// and the replication connections use it.
+func (m *MysqlConfig) setupTLS() error {
+	config, err := m.newTLSConfig()
+	if err != nil || config == nil {
+		return err
+	}
+	name := "binlog-" + m.SourceID()
+	if err := mysqldriver.RegisterTLSConfig(name, config); err != nil {
+		return err
+	}
+	m.tlsConfig, m.tls = name, config
+	return nil
+}
+
+func (m *MysqlConfig) tlsMode() string {
+	if m.TLSMode != "" {
+		return m.TLSMode
+	}
+	if m.SSL != "" || m.ClientCert != "" {
+		return TLSVerifyFull
+	}
+	return TLSDisabled
+}
+
+// isPEM tells PEM encoded values from paths to PEM files.
+func isPEM(v string) bool {
+	return strings.HasPrefix(strings.TrimSpace(v), "-----BEGIN")
+}
+
+// readPEM returns v when it is PEM encoded and the file it names otherwise.
+func readPEM(v string) ([]byte, error) {
+	if isPEM(v) {
+		return []byte(v), nil
+	}
+	return ioutil.ReadFile(v)
+}
+
+// pemFiles holds the PEM encoded values mysqldump is given, it only reads them from
+// files.
+type pemFiles struct {
+	dir  string
+	once sync.Once
+}
+
+// path returns the path of the file holding v, PEM encoded values are written to a
+// directory only the process can read.
+func (f *pemFiles) path(v, name string) (string, error) {
+	if !isPEM(v) {
+		return v, nil
+	}
+	if f.dir == "" {
+		dir, err := ioutil.TempDir("", "binlog-mysql-")
+		if err != nil {
+			return "", err
+		}
+		f.dir = dir
+	}
+	path := filepath.Join(f.dir, name)
+	return path, ioutil.WriteFile(path, []byte(v), 0600)
+}
+
+// remove deletes the files that were written, it can be called more than once.
+func (f *pemFiles) remove() {
+	f.once.Do(func() {
+		if f.dir == "" {
+			return
+		}
+		if err := os.RemoveAll(f.dir); err != nil {
+			defaultLogger.WithError(err).WithField("dir", f.dir).Warn("Unable to remove mysqldump's certificates")
+		}
+	})
+}
+
+// mysqldumpTLSOptions are the options that make the mysqldump canal runs verify the
+// server the same way the other connections do. MariaDB's client can't verify the chain
+// without the host name, so verify-ca only requires TLS there.
+func (m *MysqlConfig) mysqldumpTLSOptions(files *pemFiles) ([]string, error) {
+	mode := m.tlsMode()
+	var opts []string
+	if m.flavor() == MariaDBFlavor {
+		opts = append(opts, "--ssl")
+		if mode == TLSVerifyFull {
+			opts = append(opts, "--ssl-verify-server-cert")
+		}
+	} else {
+		switch mode {
+		case TLSSkipVerify:
+			opts = append(opts, "--ssl-mode=REQUIRED")
+		case TLSVerifyCA:
+			opts = append(opts, "--ssl-mode=VERIFY_CA")
+		default:
+			opts = append(opts, "--ssl-mode=VERIFY_IDENTITY")
+		}
+	}
+
+	if m.SSL != "" {
+		ca, err := files.path(m.SSL, "ca.pem")
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot write mysql ca for mysqldump")
+		}
+		opts = append(opts, "--ssl-ca="+ca)
+	} else if mode != TLSSkipVerify {
+		opts = append(opts, "--ssl-capath="+systemCertDir)
+	}
+	if m.ClientCert != "" {
+		cert, err := files.path(m.ClientCert, "cert.pem")
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot write mysql client certificate for mysqldump")
+		}
+		key, err := files.path(m.ClientKey, "key.pem")
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot write mysql client key for mysqldump")
+		}
+		opts = append(opts, "--ssl-cert="+cert, "--ssl-key="+key)
+	}
+	return opts, nil
+}
+
+// newTLSConfig returns nil when TLS is disabled.
+func (m *MysqlConfig) newTLSConfig() (*tls.Config, error) {
+	mode := m.tlsMode()
+	if mode == TLSDisabled {
+		return nil, nil
+	}
+
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, err
+	}
+	if m.SSL != "" {
+		ca, err := readPEM(m.SSL)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot read mysql ca")
+		}
+		if !roots.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificates found in mysql ca")
+		}
+	}
+
+	config := &tls.Config{RootCAs: roots, ServerName: m.Host}
+	if m.ClientCert != "" || m.ClientKey != "" {
+		certPEM, err := readPEM(m.ClientCert)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot read mysql client certificate")
+		}
+		keyPEM, err := readPEM(m.ClientKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot read mysql client key")
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid mysql client certificate")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	switch mode {
+	case TLSVerifyFull:
+	case TLSSkipVerify:
+		config.InsecureSkipVerify = true
+	case TLSVerifyCA:
+		// the chain is verified without checking that it was issued for the host.
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(raw, roots)
+		}
+	default:
+		return nil, errors.Errorf("unknown mysql tls mode %q", m.TLSMode)
+	}
+	return config, nil
+}
+
+func verifyChain(raw [][]byte, roots *x509.CertPool) error {
+	if len(raw) == 0 {
+		return errors.New("server sent no certificate")
+	}
+	certs := make([]*x509.Certificate, len(raw))
+	for i, b := range raw {
+		cert, err := x509.ParseCertificate(b)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+	return err
+}
+
+func (m *MysqlConfig) logger() Logger {
+	if m.Logger == nil {
+		return defaultLogger
+	}
+	return m.Logger
 }
 
 func (m *MysqlConfig) String() string {
@@ -37,13 +293,13 @@ func (m *MysqlConfig) String() string {
 
 func (m *MysqlConfig) Connect() (*sql.DB, error) {
 	db, err := sql.Open("mysql", m.DataSourceString())
-	fmt.Println(m.DataSourceString())
+	m.logger().WithField("dsn", ScrubDSN(m.DataSourceString())).Debug("Connecting to db")
 	if err != nil {
 		return nil, errors.Wrapf(err, "cannot connect to db (%s)", m)
 	} else if err := db.Ping(); err != nil {
 		return nil, errors.Wrapf(err, "cannot ping db (%s)", m)
 	} else {
-		log.Infof("successfully connected to db (%s)", m.DB)
+		m.logger().WithField("database", m.DB).Info("Successfully connected to db")
 	}
 
 	if m.MaxConnections == 0 {
@@ -96,32 +352,354 @@ func (m *MysqlConfig) EncodeFlags() string {
 }
 
 func (m *MysqlConfig) GetSyncer() *replication.BinlogSyncer {
+	serverID, err := m.replicationServerID()
+	if err != nil {
+		m.logger().WithError(err).Panic("Unable to pick a server id")
+	}
 	cfg := replication.BinlogSyncerConfig{
-		ServerID: 100,
-		Flavor:   "mysql",
-		Host:     m.Host,
-		Port:     uint16(m.Port),
-		User:     m.User,
-		Password: m.Password,
+		ServerID:        serverID,
+		Flavor:          m.flavor(),
+		Host:            m.Host,
+		Port:            uint16(m.Port),
+		User:            m.User,
+		Password:        m.Password,
+		Charset:         m.Charset,
+		SemiSyncEnabled: m.SemiSync,
+		HeartbeatPeriod: time.Duration(m.HeartbeatPeriod),
+		ReadTimeout:     time.Duration(m.ReadTimeout),
+		TLSConfig:       m.tls,
+		// decode values the same way the canal does.
+		UseDecimal:              true,
+		TimestampStringLocation: time.UTC,
 	}
 	return replication.NewBinlogSyncer(cfg)
 }
 
+func (m *MysqlConfig) flavor() string {
+	if m.Flavor == "" {
+		return MysqlFlavor
+	}
+	return m.Flavor
+}
+
+// replicationServerID returns the configured server id, picking a random one the first
+// time when RandomServerID is set so that the syncer and canal agree on it.
+func (m *MysqlConfig) replicationServerID() (uint32, error) {
+	if m.ServerID != 0 {
+		return m.ServerID, nil
+	}
+	if !m.RandomServerID {
+		return DefaultServerID, nil
+	}
+	if m.randomServerID != 0 {
+		return m.randomServerID, nil
+	}
+
+	db, err := m.Connect()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	used, err := usedServerIDs(db)
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot list the server ids in use")
+	}
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		// stay clear of the small ids servers tend to be configured with.
+		id := uint32(r.Int63n(math.MaxUint32-10000)) + 10000
+		if !used[id] {
+			m.logger().WithField("server_id", id).Info("Picked a random server id")
+			m.randomServerID = id
+			return id, nil
+		}
+	}
+}
+
+// usedServerIDs returns the ids of the server and of the replicas registered with it.
+func usedServerIDs(db *sql.DB) (map[uint32]bool, error) {
+	used := make(map[uint32]bool)
+	var own uint32
+	if err := db.QueryRow("SELECT @@server_id").Scan(&own); err != nil {
+		return nil, err
+	}
+	used[own] = true
+
+	rows, err := db.Query("SHOW SLAVE HOSTS")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		values := make([]interface{}, len(cols))
+		for i := range values {
+			values[i] = new(sql.RawBytes)
+		}
+		if err := rows.Scan(values...); err != nil {
+			return nil, err
+		}
+		// the server id is the first column in every version.
+		id, err := strconv.ParseUint(string(*values[0].(*sql.RawBytes)), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		used[uint32(id)] = true
+	}
+	return used, rows.Err()
+}
+
+// binlogGTIDSet returns the MariaDB GTID set of the transactions before pos, nil when the
+// server doesn't know it.
+func (m *MysqlConfig) binlogGTIDSet(pos mysql.Position) (mysql.GTIDSet, error) {
+	db, err := m.Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var s sql.NullString
+	if err := db.QueryRow("SELECT BINLOG_GTID_POS(?, ?)", pos.Name, pos.Pos).Scan(&s); err != nil {
+		return nil, errors.Wrapf(err, "cannot read gtid set at %s", pos)
+	}
+	if !s.Valid {
+		return nil, nil
+	}
+	set, err := mysql.ParseMariadbGTIDSet(s.String)
+	return set, errors.Wrapf(err, "invalid gtid set at %s", pos)
+}
+
+// gtidEventHandler hands the GTID set at the first synced position to the wrapped handler
+// when canal doesn't know it. Canal takes the set from the dump on MySQL, but only reads
+// positions from a MariaDB dump and doesn't track GTIDs when it streams from a position.
+type gtidEventHandler struct {
+	EventHandler
+	gtidSetAt func(mysql.Position) (mysql.GTIDSet, error)
+	known     bool
+	logger    Logger
+}
+
+func (h *gtidEventHandler) OnPosSynced(pos mysql.Position, set mysql.GTIDSet, force bool) error {
+	if !h.known && set == nil && pos.Name != "" {
+		h.known = true
+		var err error
+		if set, err = h.gtidSetAt(pos); err != nil {
+			h.logger.WithError(err).Warn("Checkpoints will only have positions")
+		} else if set == nil {
+			h.logger.WithField("position", pos).Warn("No gtid set at position, checkpoints will only have positions")
+		}
+	}
+	return h.EventHandler.OnPosSynced(pos, set, force)
+}
+
+// gtidFlavor returns the flavor of set.
+func gtidFlavor(set mysql.GTIDSet) string {
+	if _, ok := set.(*mysql.MariadbGTIDSet); ok {
+		return MariaDBFlavor
+	}
+	return MysqlFlavor
+}
+
+// SourceID identifies the database in checkpoints and heartbeats.
+func (m *MysqlConfig) SourceID() string {
+	if m.Label != "" {
+		return m.Label
+	}
+	return fmt.Sprintf("%s:%d", m.Host, m.Port)
+}
+
+// OpenCanal streams m to handler as the master, dumping DefaultMasterTables first.
 func (m *MysqlConfig) OpenCanal(handler EventHandler) context.Context {
+	return m.OpenCanalFrom(handler, nil)
+}
+
+// OpenCanalFrom starts streaming from the checkpoint instead of dumping the tables and
+// starting from the current position when one is given.
+func (m *MysqlConfig) OpenCanalFrom(handler EventHandler, cp *Checkpoint) context.Context {
+	return m.openCanal(&ShardConfig{master: true}, handler, cp)
+}
+
+func (m *MysqlConfig) openCanal(shard *ShardConfig, handler EventHandler, cp *Checkpoint) context.Context {
+	c, removePEM, err := m.newCanal(shard, handler, cp == nil)
+	if err != nil {
+		m.logger().WithError(err).Panic("Unable to start canal")
+	}
+	defer removePEM()
+	if err := m.runCanal(c, shard.ID, cp); err != nil {
+		if c.Ctx().Err() == nil {
+			// the canal never started.
+			m.logger().WithError(err).Panic("Unable to start canal")
+		}
+		m.logger().WithError(err).Error("canal stopped")
+	}
+	return c.Ctx()
+}
+
+// newCanal creates a canal for the shard that feeds handler, which dumps the tables the
+// shard streams when dump is set. The shard's own mysql config is not used, m is.
+// removePEM deletes the certificates written for mysqldump, which happens on its own once
+// the dump is done or the canal stops.
+func (m *MysqlConfig) newCanal(shard *ShardConfig, handler EventHandler, dump bool) (c *canal.Canal, removePEM func(), err error) {
 	cfg := canal.NewDefaultConfig()
 	cfg.Addr = fmt.Sprintf("%s:%d", m.Host, m.Port)
 	cfg.User = m.User
 	cfg.Password = m.Password
+	cfg.Flavor = m.flavor()
+	cfg.SemiSyncEnabled = m.SemiSync
+	cfg.HeartbeatPeriod = time.Duration(m.HeartbeatPeriod)
+	cfg.ReadTimeout = time.Duration(m.ReadTimeout)
+	if m.Charset != "" {
+		cfg.Charset = m.Charset
+	}
+	if cfg.ServerID, err = m.replicationServerID(); err != nil {
+		return nil, nil, errors.Wrap(err, "cannot pick a server id")
+	}
+	// canal's binlog and query connections and its mysqldump are encrypted like the
+	// driver's.
+	cfg.TLSConfig = m.tls
+	// decimals keep their digits and timestamps are in UTC, like mysqldump writes them,
+	// so that rows read from the dump and from the binlog look the same.
+	cfg.UseDecimal = true
+	cfg.TimestampStringLocation = time.UTC
 
-	cfg.Dump.TableDB = "sales"
-	cfg.Dump.Tables = []string{"sales"}
 	cfg.Dump.Protocol = "tcp"
+	files := &pemFiles{}
+	if !dump {
+		cfg.Dump.ExecutionPath = ""
+	} else {
+		if err := m.dumpTables(cfg, shard); err != nil {
+			return nil, nil, err
+		}
+		// the certificates are only written while mysqldump needs them.
+		if m.tls != nil {
+			if cfg.Dump.ExtraOptions, err = m.mysqldumpTLSOptions(files); err != nil {
+				files.remove()
+				return nil, nil, err
+			}
+		}
+	}
+
+	if c, err = canal.NewCanal(cfg); err != nil {
+		files.remove()
+		return nil, nil, err
+	}
+	go func() {
+		select {
+		case <-c.WaitDumpDone():
+		case <-c.Ctx().Done():
+		}
+		files.remove()
+	}()
+	if m.flavor() == MariaDBFlavor {
+		handler = &gtidEventHandler{EventHandler: handler, gtidSetAt: m.binlogGTIDSet, logger: m.logger()}
+	}
+	c.SetEventHandler(metricsEventHandler{EventHandler: handler, shard: shard.ID})
+	return c, files.remove, nil
+}
 
-	c, err := canal.NewCanal(cfg)
+// dumpTables makes canal dump the tables the shard's filters select, out of the
+// databases that have any.
+func (m *MysqlConfig) dumpTables(cfg *canal.Config, shard *ShardConfig) error {
+	filter, err := shard.dumped()
 	if err != nil {
-		log.WithError(err).Panic(err, "Unable to start canal")
+		return configError{err}
 	}
-	c.SetEventHandler(handler)
-	c.Run()
-	return c.Ctx()
+	db, err := m.Connect()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT table_schema, table_name FROM information_schema.tables
+		WHERE table_type = 'BASE TABLE'
+		AND table_schema NOT IN ('mysql', 'information_schema', 'performance_schema', 'sys')
+		ORDER BY table_schema, table_name`)
+	if err != nil {
+		return errors.Wrap(err, "cannot list the tables to dump")
+	}
+	defer rows.Close()
+	dumped := make(map[string]bool)
+	var ignored [][2]string
+	for rows.Next() {
+		var schema, table string
+		if err := rows.Scan(&schema, &table); err != nil {
+			return err
+		}
+		if filter.Match(schema, table) {
+			if !dumped[schema] {
+				cfg.Dump.Databases = append(cfg.Dump.Databases, schema)
+			}
+			dumped[schema] = true
+		} else {
+			ignored = append(ignored, [2]string{schema, table})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "cannot list the tables to dump")
+	}
+	if len(cfg.Dump.Databases) == 0 {
+		// mysqldump would dump every database.
+		return configError{errors.Errorf("no table of %s matches the shard's filters", m.SourceID())}
+	}
+	for _, t := range ignored {
+		if dumped[t[0]] {
+			cfg.Dump.IgnoreTables = append(cfg.Dump.IgnoreTables, t[0]+"."+t[1])
+		}
+	}
+	return nil
+}
+
+// canalRunner is the part of a canal runCanal uses.
+type canalRunner interface {
+	Run() error
+	RunFrom(pos mysql.Position) error
+	StartFromGTID(set mysql.GTIDSet) error
+	Ctx() context.Context
+	WaitDumpDone() <-chan struct{}
+}
+
+// runCanal streams from the checkpoint, or dumps the tables first without one, until the
+// canal stops.
+func (m *MysqlConfig) runCanal(c canalRunner, shard string, cp *Checkpoint) error {
+	var err error
+	pipelineHealth.watch(shard, c.Ctx())
+	pipelineHealth.setDumping(shard, cp == nil)
+	go func() {
+		select {
+		case <-c.WaitDumpDone():
+			pipelineHealth.setDumping(shard, false)
+		case <-c.Ctx().Done():
+		}
+	}()
+
+	switch {
+	case cp != nil && cp.GTIDSet != "":
+		if cp.Flavor != m.flavor() {
+			return configError{errors.Errorf("cannot resume a %s checkpoint on %s", cp.Flavor, m.flavor())}
+		}
+		var set mysql.GTIDSet
+		if set, err = cp.GTIDs(); err != nil {
+			return configError{errors.Wrap(err, "cannot resume from checkpoint")}
+		}
+		m.logger().WithFields(Fields{
+			"shard":    shard,
+			"gtid_set": set,
+		}).Info("Resuming canal from checkpoint")
+		err = c.StartFromGTID(set)
+	case cp != nil:
+		m.logger().WithFields(Fields{
+			"shard":    shard,
+			"position": cp.Position,
+		}).Info("Resuming canal from checkpoint")
+		err = c.RunFrom(cp.Position)
+	default:
+		err = c.Run()
+	}
+	if err != nil {
+		pipelineHealth.setError(shard, err)
+	}
+	return err
 }
@@ -0,0 +1,68 @@
+package binlog
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testPEM = "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"
+
+func TestMysqldumpCertificatesAreRemoved(t *testing.T) {
+	m := &MysqlConfig{SSL: testPEM, ClientCert: testPEM, ClientKey: "/etc/mysql/client-key.pem"}
+	files := &pemFiles{}
+	opts, err := m.mysqldumpTLSOptions(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var written []string
+	for _, opt := range opts {
+		parts := strings.SplitN(opt, "=", 2)
+		switch parts[0] {
+		case "--ssl-ca", "--ssl-cert":
+			written = append(written, parts[1])
+		case "--ssl-key":
+			// paths are passed on as they are.
+			if parts[1] != m.ClientKey {
+				t.Errorf("got key %s, want %s", parts[1], m.ClientKey)
+			}
+		}
+	}
+	if len(written) != 2 {
+		t.Fatalf("got options %v, want the ca and the certificate written out", opts)
+	}
+	for _, path := range written {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("%s can be read by others: %v", path, info.Mode())
+		}
+		if b, err := ioutil.ReadFile(path); err != nil || string(b) != testPEM {
+			t.Errorf("got %q from %s (%v)", b, path, err)
+		}
+	}
+
+	files.remove()
+	files.remove()
+	for _, path := range append(written, files.dir) {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed: %v", path, err)
+		}
+	}
+}
+
+func TestMysqldumpWithoutPEMWritesNothing(t *testing.T) {
+	m := &MysqlConfig{SSL: "/etc/mysql/ca.pem"}
+	files := &pemFiles{}
+	if _, err := m.mysqldumpTLSOptions(files); err != nil {
+		t.Fatal(err)
+	}
+	if files.dir != "" {
+		t.Errorf("wrote %s for certificates that are already files", files.dir)
+	}
+	files.remove()
+}
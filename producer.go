@@ -0,0 +1,138 @@
+package binlog
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+	kafka "github.com/segmentio/kafka-go"
+)
+
+const (
+	KafkaGoProducer = "kafka-go"
+	SaramaProducer  = "sarama"
+)
+
+// Producer writes messages to kafka. Every message must have its Topic set, messages for
+// the same topic are written in the order given.
+type Producer interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// NewProducer creates a producer for the local brokers using the configured backend.
+func (k *kafkaConfig) NewProducer() (Producer, error) {
+	switch k.Producer {
+	case "", KafkaGoProducer:
+		return newKafkaGoProducer(k), nil
+	case SaramaProducer:
+		return newSaramaProducer(k)
+	default:
+		return nil, errors.Errorf("unknown kafka producer %q", k.Producer)
+	}
+}
+
+// kafkaGoProducer keeps a kafka-go writer per topic since a writer can only produce to
+// the topic it was created with.
+type kafkaGoProducer struct {
+	config  *kafkaConfig
+	writers map[string]*kafka.Writer
+	sync    *sync.Mutex
+}
+
+func newKafkaGoProducer(k *kafkaConfig) *kafkaGoProducer {
+	return &kafkaGoProducer{
+		config:  k,
+		writers: make(map[string]*kafka.Writer),
+		sync:    new(sync.Mutex),
+	}
+}
+
+func (p *kafkaGoProducer) writer(topic string) *kafka.Writer {
+	p.sync.Lock()
+	defer p.sync.Unlock()
+	w, ok := p.writers[topic]
+	if !ok {
+		config := p.config.WriteConfiger(topic)
+		// Hash uses the same FNV-1a partitioning as sarama's hash partitioner.
+		config.Balancer = &kafka.Hash{}
+		w = kafka.NewWriter(*config)
+		p.writers[topic] = w
+	}
+	return w
+}
+
+func (p *kafkaGoProducer) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	var topics []string
+	byTopic := make(map[string][]kafka.Message)
+	for _, m := range msgs {
+		if _, ok := byTopic[m.Topic]; !ok {
+			topics = append(topics, m.Topic)
+		}
+		byTopic[m.Topic] = append(byTopic[m.Topic], m)
+	}
+
+	for _, topic := range topics {
+		if err := p.writer(topic).WriteMessages(ctx, byTopic[topic]...); err != nil {
+			return errors.Wrapf(err, "cannot write to %s", topic)
+		}
+	}
+	return nil
+}
+
+func (p *kafkaGoProducer) Close() error {
+	p.sync.Lock()
+	defer p.sync.Unlock()
+	var err error
+	for topic, w := range p.writers {
+		if cerr := w.Close(); cerr != nil {
+			err = errors.Wrapf(cerr, "cannot close writer for %s", topic)
+		}
+	}
+	return err
+}
+
+type saramaProducer struct {
+	producer sarama.SyncProducer
+}
+
+func newSaramaProducer(k *kafkaConfig) (*saramaProducer, error) {
+	config, err := saramaConfig(k, false)
+	if err != nil {
+		return nil, err
+	}
+	if k.Idempotent {
+		config.Version = sarama.V0_11_0_0
+		config.Producer.Idempotent = true
+		config.Producer.RequiredAcks = sarama.WaitForAll
+		config.Net.MaxOpenRequests = 1
+	}
+
+	p, err := sarama.NewSyncProducer(k.Brokers.Local, config)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create sarama producer")
+	}
+	return &saramaProducer{producer: p}, nil
+}
+
+func (p *saramaProducer) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	return p.producer.SendMessages(producerMessages(msgs))
+}
+
+func producerMessages(msgs []kafka.Message) []*sarama.ProducerMessage {
+	pmsgs := make([]*sarama.ProducerMessage, len(msgs))
+	for i, m := range msgs {
+		pmsgs[i] = &sarama.ProducerMessage{
+			Topic:     m.Topic,
+			Key:       sarama.ByteEncoder(m.Key),
+			Value:     sarama.ByteEncoder(m.Value),
+			Timestamp: m.Time,
+		}
+	}
+	return pmsgs
+}
+
+func (p *saramaProducer) Close() error {
+	return p.producer.Close()
+}
@@ -0,0 +1,88 @@
+package binlog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	kafka "github.com/segmentio/kafka-go"
+)
+
+// ConsumerProgress is the next offset to read of every partition of a topic a tool
+// consumes, so that a rerun carries on where the last one stopped. It is kept in the
+// compacted checkpoint topic, keyed by the consumer's name and the partition.
+type ConsumerProgress struct {
+	config   *kafkaConfig
+	producer Producer
+	topic    string
+	name     string
+	offsets  map[int]int64
+}
+
+type partitionProgress struct {
+	Partition int   `json:"partition"`
+	Offset    int64 `json:"offset"`
+}
+
+// LoadConsumerProgress reads the progress saved for name, which should identify both the
+// tool and the topic it consumes.
+func (k *kafkaConfig) LoadConsumerProgress(ctx context.Context, producer Producer, name string) (*ConsumerProgress, error) {
+	topic := k.CheckpointTopic
+	if topic == "" {
+		topic = DefaultCheckpointTopic
+	}
+	if err := k.EnsureCompactedTopic(ctx, topic, 1); err != nil {
+		return nil, err
+	}
+	p := &ConsumerProgress{
+		config:   k,
+		producer: producer,
+		topic:    topic,
+		name:     name,
+		offsets:  make(map[int]int64),
+	}
+	err := k.ReadTopic(ctx, topic, func(m kafka.Message) error {
+		if !strings.HasPrefix(string(m.Key), name+"/") || m.Value == nil {
+			return nil
+		}
+		var pp partitionProgress
+		if err := json.Unmarshal(m.Value, &pp); err != nil {
+			return errors.Wrapf(err, "invalid progress at offset %d", m.Offset)
+		}
+		p.offsets[pp.Partition] = pp.Offset
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Offset returns where to start reading partition, kafka.FirstOffset when nothing of it
+// has been read yet.
+func (p *ConsumerProgress) Offset(partition int) int64 {
+	if offset, ok := p.offsets[partition]; ok {
+		return offset
+	}
+	return kafka.FirstOffset
+}
+
+// Save records that partition is to be read from next on.
+func (p *ConsumerProgress) Save(ctx context.Context, partition int, next int64) error {
+	value, err := json.Marshal(partitionProgress{Partition: partition, Offset: next})
+	if err != nil {
+		return err
+	}
+	err = write(ctx, p.producer, []kafka.Message{{
+		Topic: p.topic,
+		Key:   []byte(fmt.Sprintf("%s/%d", p.name, partition)),
+		Value: value,
+	}})
+	if err != nil {
+		return errors.Wrapf(err, "cannot save progress of %s", p.name)
+	}
+	p.offsets[partition] = next
+	return nil
+}
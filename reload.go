@@ -0,0 +1,153 @@
+package binlog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// reloadableKafkaFields are the kafka settings a running handler picks up, see Configure.
+var reloadableKafkaFields = map[string]bool{
+	"_topic":             true,
+	"_dead_letter_topic": true,
+	"_max_message_bytes": true,
+	"_tombstones":        true,
+	"_flush_interval":    true,
+}
+
+// reloadableShardFields are the shard settings a running handler picks up.
+var reloadableShardFields = map[string]bool{
+	"_include_tables": true,
+	"_exclude_tables": true,
+	// the fields of the mysql config are listed on their own.
+	"_mysql": true,
+}
+
+// RestartRequired lists the fields that differ in next and can only be applied by
+// restarting, such as the servers connected to and the server ids used.
+func (s *Secrets) RestartRequired(next *Secrets) []string {
+	var changed []string
+	add := func(prefix string, fields []string, reloadable map[string]bool) {
+		for _, f := range fields {
+			if !reloadable[f] {
+				changed = append(changed, prefix+f)
+			}
+		}
+	}
+
+	add("_kafka.", changedFields(s.Kafka, next.Kafka), reloadableKafkaFields)
+	add("_zk.", changedFields(s.Zk, next.Zk), nil)
+	add("_master_mysql.", changedFields(s.Master, next.Master), nil)
+	add("_heartbeat.", changedFields(s.Heartbeat, next.Heartbeat), nil)
+
+	shards := make(map[string]*ShardConfig, len(next.Shards))
+	for i := range next.Shards {
+		shards[next.Shards[i].ID] = &next.Shards[i]
+	}
+	for i := range s.Shards {
+		sh := &s.Shards[i]
+		n, ok := shards[sh.ID]
+		if !ok {
+			changed = append(changed, "_shards."+sh.ID+" removed")
+			continue
+		}
+		delete(shards, sh.ID)
+		add("_shards."+sh.ID+".", changedFields(*sh, *n), reloadableShardFields)
+		add("_shards."+sh.ID+"._mysql.", changedFields(sh.Mysql, n.Mysql), nil)
+	}
+	for id := range shards {
+		changed = append(changed, "_shards."+id+" added")
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// changedFields returns the json names of the fields that differ between a and b, which
+// must be structs of the same type.
+func changedFields(a, b interface{}) []string {
+	var before, after map[string]json.RawMessage
+	if err := remarshal(a, &before); err != nil {
+		return []string{err.Error()}
+	}
+	if err := remarshal(b, &after); err != nil {
+		return []string{err.Error()}
+	}
+
+	var changed []string
+	for name, v := range before {
+		if !bytes.Equal(v, after[name]) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+func remarshal(v interface{}, fields *map[string]json.RawMessage) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, fields)
+}
+
+// WatchSecrets parses the secrets in dir again whenever the process receives SIGHUP or,
+// when poll is set, the secrets files change, and calls reload with them. Secrets that
+// can't be parsed are logged and skipped.
+func WatchSecrets(ctx context.Context, dir string, poll time.Duration, reload func(*Secrets)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if poll > 0 {
+		ticker := time.NewTicker(poll)
+		tick = ticker.C
+		defer ticker.Stop()
+	}
+
+	modified := secretsModTime(dir)
+	for {
+		select {
+		case <-ctx.Done():
+			signal.Stop(hup)
+			return
+		case <-hup:
+			defaultLogger.Info("Received SIGHUP, reloading secrets")
+		case <-tick:
+			m := secretsModTime(dir)
+			if !m.After(modified) {
+				continue
+			}
+			defaultLogger.WithField("dir", dir).Info("Secrets changed, reloading them")
+		}
+		modified = secretsModTime(dir)
+
+		s, err := ParseSecretsFile(dir)
+		if err != nil {
+			defaultLogger.WithError(err).Error("Unable to reload secrets, keeping the current ones")
+			continue
+		}
+		reload(s)
+	}
+}
+
+// secretsModTime is the last time one of the secrets files in dir was modified.
+func secretsModTime(dir string) time.Time {
+	var latest time.Time
+	for _, name := range []string{"secrets.ejson", "secrets.json"} {
+		if fi, err := os.Stat(filepath.Join(dir, name)); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
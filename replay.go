@@ -0,0 +1,254 @@
+package binlog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/satori/go.uuid"
+	"github.com/siddontang/go-mysql/canal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/siddontang/go-mysql/schema"
+)
+
+// SchemaSnapshot holds the tables needed to decode row events without a server, keyed by
+// schema.table. There is no schema history topic, so a snapshot describes the tables as
+// they were when it was taken and isn't changed by DDL that is replayed.
+type SchemaSnapshot map[string]*schema.Table
+
+// TakeSchemaSnapshot reads the given schema.table names from db.
+func TakeSchemaSnapshot(db *sql.DB, tables []string) (SchemaSnapshot, error) {
+	s := make(SchemaSnapshot)
+	for _, name := range tables {
+		parts := strings.SplitN(name, ".", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("table %q must be given as schema.table", name)
+		}
+		t, err := schema.NewTableFromSqlDB(db, parts[0], parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read schema of %s", name)
+		}
+		s[name] = t
+	}
+	return s, nil
+}
+
+func ReadSchemaSnapshot(path string) (SchemaSnapshot, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := make(SchemaSnapshot)
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, errors.Wrap(err, "invalid schema snapshot")
+	}
+	return s, nil
+}
+
+func (s SchemaSnapshot) Write(path string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// ReplayArchive feeds the events archived in dir, starting after from, to the handler
+// the same way canal does when streaming from a server. The whole archive is replayed
+// when from is empty.
+func ReplayArchive(dir string, from mysql.Position, tables SchemaSnapshot, handler EventHandler) error {
+	m, err := ReadArchiveManifest(dir)
+	if err != nil {
+		return err
+	}
+	r := &replayer{
+		tables:  tables,
+		handler: metricsEventHandler{EventHandler: handler},
+	}
+
+	started := from.Name == ""
+	for _, f := range m.Files {
+		if !started && f.Name != from.Name {
+			continue
+		}
+		start := uint32(0)
+		if !started {
+			start = from.Pos
+			started = true
+		}
+		if err := r.replayFile(dir, f, start); err != nil {
+			return errors.Wrapf(err, "cannot replay %s", f.Name)
+		}
+	}
+	if !started {
+		return errors.Errorf("%s is not in the archive", from.Name)
+	}
+	return nil
+}
+
+type replayer struct {
+	tables  SchemaSnapshot
+	handler EventHandler
+	pos     mysql.Position
+}
+
+func (r *replayer) replayFile(dir string, f *ArchivedFile, start uint32) error {
+	file, err := os.Open(filepath.Join(dir, f.Path))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// anything past the last sync may be a partially written event.
+	var in io.Reader = io.LimitReader(file, f.Size)
+	if f.Compressed {
+		gz, err := gzip.NewReader(in)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		in = gz
+	}
+
+	header := make([]byte, len(replication.BinLogFileHeader))
+	if _, err := io.ReadFull(in, header); err != nil {
+		return err
+	}
+	if !bytes.Equal(header, replication.BinLogFileHeader) {
+		return errors.New("not a binlog file")
+	}
+
+	defaultLogger.WithFields(Fields{
+		"file": f.Name,
+		"pos":  start,
+	}).Info("Replaying archived binlog file")
+	r.pos = mysql.Position{Name: f.Name, Pos: 4}
+	// the format description at the start of the file is always parsed so that the events
+	// after start can be decoded.
+	p := replication.NewBinlogParser()
+	p.SetUseDecimal(true)
+	p.SetTimestampStringLocation(time.UTC)
+	return p.ParseReader(in, func(ev *replication.BinlogEvent) error {
+		if ev.Header.LogPos <= start {
+			return nil
+		}
+		return r.onEvent(ev)
+	})
+}
+
+// onEvent mirrors how canal dispatches the events it reads from a server.
+func (r *replayer) onEvent(ev *replication.BinlogEvent) error {
+	pos := r.pos
+	pos.Pos = ev.Header.LogPos
+	savePos, force := false, false
+
+	switch e := ev.Event.(type) {
+	case *replication.RotateEvent:
+		pos.Name, pos.Pos = string(e.NextLogName), uint32(e.Position)
+		savePos, force = true, true
+		if err := r.handler.OnRotate(e); err != nil {
+			return err
+		}
+	case *replication.RowsEvent:
+		return r.onRows(ev, e)
+	case *replication.XIDEvent:
+		savePos = true
+		if err := r.handler.OnXID(pos); err != nil {
+			return err
+		}
+	case *replication.MariadbGTIDEvent:
+		gtid, err := mysql.ParseMariadbGTIDSet(e.GTID.String())
+		if err != nil {
+			return err
+		}
+		if err := r.handler.OnGTID(gtid); err != nil {
+			return err
+		}
+	case *replication.GTIDEvent:
+		u, _ := uuid.FromBytes(e.SID)
+		gtid, err := mysql.ParseMysqlGTIDSet(fmt.Sprintf("%s:%d", u.String(), e.GNO))
+		if err != nil {
+			return err
+		}
+		if err := r.handler.OnGTID(gtid); err != nil {
+			return err
+		}
+	case *replication.QueryEvent:
+		if strings.EqualFold(strings.TrimSpace(string(e.Query)), "BEGIN") {
+			break
+		}
+		defaultLogger.WithField("query", string(e.Query)).Warn("Replaying DDL without updating the schema snapshot")
+		savePos, force = true, true
+		if err := r.handler.OnDDL(pos, e); err != nil {
+			return err
+		}
+	}
+
+	r.pos = pos
+	if savePos {
+		return r.handler.OnPosSynced(pos, nil, force)
+	}
+	return nil
+}
+
+func (r *replayer) onRows(ev *replication.BinlogEvent, e *replication.RowsEvent) error {
+	name := fmt.Sprintf("%s.%s", e.Table.Schema, e.Table.Table)
+	t, ok := r.tables[name]
+	if !ok {
+		defaultLogger.WithField("table", name).Debug("Skipping rows of table missing from the schema snapshot")
+		return nil
+	}
+
+	var action string
+	switch ev.Header.EventType {
+	case replication.WRITE_ROWS_EVENTv1, replication.WRITE_ROWS_EVENTv2:
+		action = canal.InsertAction
+	case replication.DELETE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv2:
+		action = canal.DeleteAction
+	case replication.UPDATE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv2:
+		action = canal.UpdateAction
+	default:
+		return errors.Errorf("%s not supported", ev.Header.EventType)
+	}
+	unsignedRows(t, e.Rows)
+	return r.handler.OnRow(&canal.RowsEvent{
+		Table:  t,
+		Action: action,
+		Rows:   e.Rows,
+		Header: ev.Header,
+	})
+}
+
+// unsignedRows converts unsigned columns like canal does, the binlog decodes every
+// integer as signed.
+func unsignedRows(t *schema.Table, rows [][]interface{}) {
+	for _, row := range rows {
+		for _, i := range t.UnsignedColumns {
+			if i >= len(row) {
+				continue
+			}
+			switch v := row[i].(type) {
+			case int8:
+				row[i] = uint8(v)
+			case int16:
+				row[i] = uint16(v)
+			case int32:
+				row[i] = uint32(v)
+			case int64:
+				row[i] = uint64(v)
+			case int:
+				row[i] = uint(v)
+			}
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package binlog
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// SecretsEnvPrefix prefixes the environment variables that set secrets fields, eg.
+	// BINLOG_MASTER_MYSQL_PASSWORD sets the password of _master_mysql.
+	SecretsEnvPrefix = "BINLOG"
+	// DefaultEJSONKeyDir is where ejson looks for private keys unless EJSON_KEYDIR is set.
+	DefaultEJSONKeyDir = "/opt/ejson/keys"
+)
+
+// SecretSource looks up values for secrets fields by the name of their environment
+// variable.
+type SecretSource interface {
+	Lookup(name string) (value string, ok bool, err error)
+}
+
+// EnvSource reads values from environment variables.
+type EnvSource struct{}
+
+func (EnvSource) Lookup(name string) (string, bool, error) {
+	v, ok := os.LookupEnv(name)
+	return v, ok, nil
+}
+
+// EnvFileSource reads values from the file named by the field's variable suffixed with
+// _FILE, eg. BINLOG_MASTER_MYSQL_PASSWORD_FILE.
+type EnvFileSource struct{}
+
+func (EnvFileSource) Lookup(name string) (string, bool, error) {
+	path, ok := os.LookupEnv(name + "_FILE")
+	if !ok {
+		return "", false, nil
+	}
+	return readSecretFile(path)
+}
+
+// DirSource reads values from files in a directory named after the field's variable, as
+// kubernetes mounts secrets.
+type DirSource struct {
+	Dir string
+}
+
+func (s DirSource) Lookup(name string) (string, bool, error) {
+	v, ok, err := readSecretFile(filepath.Join(s.Dir, name))
+	if os.IsNotExist(errors.Cause(err)) {
+		return "", false, nil
+	}
+	return v, ok, err
+}
+
+func readSecretFile(path string) (string, bool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", false, errors.Wrapf(err, "cannot read secret from %s", path)
+	}
+	// mounted secrets and files written by editors often end with a newline.
+	return strings.TrimRight(string(b), "\r\n"), true, nil
+}
+
+// DefaultSecretSources are the sources ParseSecrets applies, in order, so that values from
+// the environment win over the others. Files in BINLOG_SECRETS_DIR are read when it is set.
+func DefaultSecretSources() []SecretSource {
+	var sources []SecretSource
+	if dir := os.Getenv(SecretsEnvPrefix + "_SECRETS_DIR"); dir != "" {
+		sources = append(sources, DirSource{Dir: dir})
+	}
+	return append(sources, EnvFileSource{}, EnvSource{})
+}
+
+// ejsonKeyDir is where the private keys to decrypt secrets.ejson are.
+func ejsonKeyDir() string {
+	if dir := os.Getenv("EJSON_KEYDIR"); dir != "" {
+		return dir
+	}
+	return DefaultEJSONKeyDir
+}
+
+// ApplySecretSources sets every field of secrets that one of the sources has a value for.
+// Later sources override earlier ones.
+func ApplySecretSources(secrets *Secrets, sources ...SecretSource) error {
+	var applied []string
+	for _, source := range sources {
+		names, err := applySource(reflect.ValueOf(secrets).Elem(), SecretsEnvPrefix, source)
+		if err != nil {
+			return err
+		}
+		applied = append(applied, names...)
+	}
+	if len(applied) > 0 {
+		defaultLogger.WithField("fields", applied).Info("Applied secrets from the environment")
+	}
+	return nil
+}
+
+func applySource(v reflect.Value, prefix string, source SecretSource) ([]string, error) {
+	var applied []string
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("json"), ",")[0]
+		if field.PkgPath != "" || tag == "-" || tag == "" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(strings.TrimPrefix(tag, "_"))
+
+		f := v.Field(i)
+		if f.Kind() == reflect.Struct {
+			names, err := applySource(f, name, source)
+			if err != nil {
+				return nil, err
+			}
+			applied = append(applied, names...)
+			continue
+		}
+
+		value, ok, err := source.Lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if err := setField(f, value); err != nil {
+			return nil, errors.Wrapf(err, "invalid value for %s", name)
+		}
+		applied = append(applied, name)
+	}
+	return applied, nil
+}
+
+// setField sets a field from its text form. Lists are comma separated.
+func setField(f reflect.Value, value string) error {
+	if f.Type() == reflect.TypeOf(Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(d))
+		return nil
+	}
+
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetUint(n)
+	case reflect.Slice:
+		switch f.Type().Elem().Kind() {
+		case reflect.Uint8:
+			f.SetBytes([]byte(value))
+		case reflect.String:
+			f.Set(reflect.ValueOf(strings.Split(value, ",")))
+		default:
+			return errors.Errorf("unsupported list of %s", f.Type().Elem())
+		}
+	default:
+		return errors.Errorf("unsupported type %s", f.Type())
+	}
+	return nil
+}
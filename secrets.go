@@ -1,17 +1,24 @@
 package binlog
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/Shopify/ejson"
 	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
 	kafka "github.com/segmentio/kafka-go"
-	log "github.com/sirupsen/logrus"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+	xscram "github.com/xdg-go/scram"
 )
 
 type kafkaConfig struct {
@@ -20,14 +27,57 @@ type kafkaConfig struct {
 		Local     []string `json:"_local"`
 	} `json:"_brokers"`
 
+	// Topic is the topic change events are written to, {schema} and {table} are replaced
+	// by the table the event is for.
+	Topic string `json:"_topic,omitempty"`
+	// DeadLetterTopic receives the row changes that can't be converted or routed. When it
+	// is not set such a change stops the pipeline.
+	DeadLetterTopic string `json:"_dead_letter_topic,omitempty"`
+	MaxMessageBytes int    `json:"_max_message_bytes,omitempty"`
+	// Tombstones follows deletes with a null valued message for the row's key, for topics
+	// that are log compacted.
+	Tombstones bool `json:"_tombstones,omitempty"`
+	// FlushInterval is how often buffered events are written, every second by default.
+	FlushInterval Duration `json:"_flush_interval,omitempty"`
+	// Aggregate mirrors selected topics to the aggregate brokers.
+	Aggregate aggregateConfig `json:"_aggregate"`
+
+	// Producer selects the client used to write to kafka, kafka-go or sarama.
+	Producer string `json:"_producer,omitempty"`
+	// Idempotent enables the idempotent sarama producer, it requires kafka 0.11 or later.
+	Idempotent bool `json:"_idempotent,omitempty"`
+	// Checkpoints enables saving the binlog position to the compacted CheckpointTopic.
+	Checkpoints     bool   `json:"_checkpoints,omitempty"`
+	CheckpointTopic string `json:"_checkpoint_topic,omitempty"`
+	// TransactionalID makes the sarama producer of every source write its events and the
+	// checkpoint after them in one transaction, with the source id appended to it. Readers
+	// then only see committed transactions.
+	TransactionalID string `json:"_transactional_id,omitempty"`
+	// ReplicationFactor of the topics created by the pipeline, 3 by default.
+	ReplicationFactor int `json:"_replication_factor,omitempty"`
+
+	// TLS enables TLS against the system roots even when no certificates are configured.
+	TLS        bool   `json:"_tls,omitempty"`
 	ClientKey  []byte `json:"client_key"`
 	ClientCert []byte `json:"client_cert"`
+	// CACert is a PEM bundle trusted in addition to the system roots.
+	CACert []byte `json:"ca_cert"`
+
+	SASL struct {
+		// Mechanism is one of PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512.
+		Mechanism string `json:"_mechanism,omitempty"`
+		Username  string `json:"_username,omitempty"`
+		Password  string `json:"password,omitempty"`
+	} `json:"_sasl"`
+
+	dialer *kafka.Dialer
 }
 
 func (k *kafkaConfig) WriteConfiger(topic string) *kafka.WriterConfig {
 	return &kafka.WriterConfig{
 		Brokers: k.Brokers.Local,
 		Topic:   topic,
+		Dialer:  k.dialer,
 	}
 }
 
@@ -36,12 +86,99 @@ func (k *kafkaConfig) ReadConfiger(topic string, partition int) *kafka.ReaderCon
 		Brokers:   k.Brokers.Local,
 		Topic:     topic,
 		Partition: partition,
+		Dialer:    k.dialer,
 		MinBytes:  10e3, //10KiB
 		MaxBytes:  10e6, //10MiB
 	}
 	return r
 }
 
+// newDialer builds the kafka-go dialer for the configured TLS and SASL settings. It returns
+// nil when neither is configured so that kafka-go falls back to its default dialer.
+func (k *kafkaConfig) newDialer() (*kafka.Dialer, error) {
+	tlsConfig, err := k.tlsConfig(false)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil && k.SASL.Mechanism == "" {
+		return nil, nil
+	}
+
+	dialer := &kafka.Dialer{
+		Timeout:   10 * time.Second,
+		DualStack: true,
+		TLS:       tlsConfig,
+	}
+
+	switch strings.ToUpper(k.SASL.Mechanism) {
+	case "":
+	case "PLAIN":
+		dialer.SASLMechanism = plain.Mechanism{
+			Username: k.SASL.Username,
+			Password: k.SASL.Password,
+		}
+	case "SCRAM-SHA-256":
+		dialer.SASLMechanism, err = scram.Mechanism(scram.SHA256, k.SASL.Username, k.SASL.Password)
+	case "SCRAM-SHA-512":
+		dialer.SASLMechanism, err = scram.Mechanism(scram.SHA512, k.SASL.Username, k.SASL.Password)
+	default:
+		err = errors.Errorf("unsupported sasl mechanism %q", k.SASL.Mechanism)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return dialer, nil
+}
+
+// tlsConfig returns nil when TLS has not been configured. When isFile is set the client
+// key, cert and ca are paths to PEM files rather than the PEM encoded values.
+func (k *kafkaConfig) tlsConfig(isFile bool) (*tls.Config, error) {
+	if !k.TLS && len(k.CACert) == 0 && (len(k.ClientKey) == 0 || len(k.ClientCert) == 0) {
+		return nil, nil
+	}
+
+	certPool, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{RootCAs: certPool}
+
+	if len(k.CACert) > 0 {
+		ca := k.CACert
+		if isFile {
+			if ca, err = ioutil.ReadFile(string(k.CACert)); err != nil {
+				return nil, err
+			}
+		}
+		if !certPool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificates found in kafka ca_cert")
+		}
+	}
+
+	if len(k.ClientKey) == 0 || len(k.ClientCert) == 0 {
+		return config, nil
+	}
+
+	var cert tls.Certificate
+	if isFile {
+		keyFile := string(k.ClientKey)
+		certFile := string(k.ClientCert)
+		defaultLogger.WithFields(Fields{
+			"Key":  keyFile,
+			"Cert": certFile,
+		}).Info("Parsing Client Key and Cert")
+
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	} else {
+		cert, err = tls.X509KeyPair(k.ClientCert, k.ClientKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	config.Certificates = []tls.Certificate{cert}
+	return config, nil
+}
+
 type Secrets struct {
 	Kafka kafkaConfig `json:"_kafka"`
 
@@ -52,14 +189,61 @@ type Secrets struct {
 		RootPath string `json:"_root_path"`
 		// TODO: remove once kafka offset tracking is working
 		Cluster string `json:"_cluster"`
+		// Election makes the processes streaming a shard elect a leader through a lock
+		// under RootPath, only the leader streams and the others stand by.
+		Election       bool     `json:"_election,omitempty"`
+		SessionTimeout Duration `json:"_session_timeout,omitempty"`
 	} `json:"_zk"`
 
 	Master MysqlConfig `json:"_master_mysql"`
+	// MasterIncludeTables and MasterExcludeTables select the master's tables the way a
+	// shard's IncludeTables and ExcludeTables do. Without either every table is streamed
+	// but only DefaultMasterTables are dumped.
+	MasterIncludeTables []string `json:"_master_include_tables,omitempty"`
+	MasterExcludeTables []string `json:"_master_exclude_tables,omitempty"`
+	// Shards are streamed instead of the master when there are any.
+	Shards []ShardConfig `json:"_shards,omitempty"`
+
+	Heartbeat HeartbeatConfig `json:"_heartbeat"`
+
+	// LogLevel overrides the level set by the command's flags when it is set.
+	LogLevel string `json:"_log_level,omitempty"`
 }
 
+// Duration is a time.Duration that is written as a string (eg. "1s") in the secrets file.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(dur)
+	return nil
+}
+
+// ParseSecretsFile reads secrets.ejson from dir, decrypting it with the keys in
+// EJSON_KEYDIR or EJSON_PRIVATE_KEY, or secrets.json when there is no ejson file.
 func ParseSecretsFile(dir string) (*Secrets, error) {
 	var filename string
 
+	filename = filepath.Join(dir, "secrets.ejson")
+	if _, err := os.Stat(filename); err == nil {
+		b, err := ejson.DecryptFile(filename, ejsonKeyDir(), os.Getenv("EJSON_PRIVATE_KEY"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot decrypt %s", filename)
+		}
+		return ParseSecrets(bytes.NewReader(b), dir)
+	}
+
 	filename = filepath.Join(dir, "secrets.json")
 
 	file, err := os.Open(filename)
@@ -79,12 +263,42 @@ func ParseSecrets(reader io.Reader, configDir string) (s *Secrets, err error) {
 	}
 
 	EnvironmentOverrides(s)
+	if err = ApplySecretSources(s, DefaultSecretSources()...); err != nil {
+		return
+	}
 
+	// the TLS and SASL configs are only built from values that make sense so that every
+	// problem is reported at once.
+	v := &validator{}
+	s.validateValues(v)
+	if err = v.err(); err != nil {
+		return
+	}
+
+	s.Kafka.dialer, err = s.Kafka.newDialer()
+	if err != nil {
+		err = errors.Wrap(err, "invalid kafka tls or sasl configuration")
+		return
+	}
+	if err = s.Master.setupTLS(); err != nil {
+		err = errors.Wrap(err, "invalid mysql tls configuration")
+		return
+	}
+	for i := range s.Shards {
+		sh := &s.Shards[i]
+		if sh.Mysql.Label == "" {
+			sh.Mysql.Label = sh.ID
+		}
+		if err = sh.Mysql.setupTLS(); err != nil {
+			err = errors.Wrapf(err, "invalid mysql tls configuration for shard %s", sh.ID)
+			return
+		}
+	}
 	return
 }
 
 func EnvironmentOverrides(secrets *Secrets) {
-	entry := log.NewEntry(log.StandardLogger())
+	entry := defaultLogger
 
 	if zkPeers := os.Getenv("ZOOKEEPER_PEERS"); zkPeers != "" {
 		secrets.Zk.Nodes = strings.Split(zkPeers, ",")
@@ -104,6 +318,20 @@ func EnvironmentOverrides(secrets *Secrets) {
 		secrets.Kafka.ClientCert = []byte(cert)
 		secrets.Kafka.ClientKey = []byte(key)
 	}
+	if ca := os.Getenv("KAFKA_CA_CERT"); ca != "" {
+		secrets.Kafka.CACert = []byte(ca)
+	}
+	if mechanism := os.Getenv("KAFKA_SASL_MECHANISM"); mechanism != "" {
+		secrets.Kafka.SASL.Mechanism = mechanism
+		entry = entry.WithField("KAFKA_SASL_MECHANISM", mechanism)
+	}
+	if user := os.Getenv("KAFKA_SASL_USERNAME"); user != "" {
+		secrets.Kafka.SASL.Username = user
+		entry = entry.WithField("KAFKA_SASL_USERNAME", user)
+	}
+	if password := os.Getenv("KAFKA_SASL_PASSWORD"); password != "" {
+		secrets.Kafka.SASL.Password = password
+	}
 
 	entry.Info("environment overrides")
 }
@@ -116,37 +344,58 @@ func saramaConfig(kConfig *kafkaConfig, isFile bool) (*sarama.Config, error) {
 	// partition being produced to.
 	config.Producer.Partitioner = sarama.NewHashPartitioner
 
-	certPool, err := x509.SystemCertPool()
+	// Configure SSL.
+	tlsConfig, err := kConfig.tlsConfig(isFile)
 	if err != nil {
 		return nil, err
 	}
+	if tlsConfig != nil {
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
 
-	if len(kConfig.ClientKey) == 0 || len(kConfig.ClientCert) == 0 {
+	// Configure SASL the same way as the kafka-go dialer.
+	sasl := &config.Net.SASL
+	switch strings.ToUpper(kConfig.SASL.Mechanism) {
+	case "":
 		return config, nil
+	case "PLAIN":
+		sasl.Mechanism = sarama.SASLTypePlaintext
+	case "SCRAM-SHA-256":
+		sasl.Mechanism = sarama.SASLTypeSCRAMSHA256
+		sasl.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &scramClient{hash: xscram.SHA256} }
+	case "SCRAM-SHA-512":
+		sasl.Mechanism = sarama.SASLTypeSCRAMSHA512
+		sasl.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &scramClient{hash: xscram.SHA512} }
+	default:
+		return nil, errors.Errorf("unsupported sasl mechanism %q", kConfig.SASL.Mechanism)
 	}
+	sasl.Enable = true
+	sasl.Handshake = true
+	sasl.User = kConfig.SASL.Username
+	sasl.Password = kConfig.SASL.Password
+	return config, nil
+}
 
-	// Configure SSL.
-	var cert tls.Certificate
-	if isFile {
-		keyFile := string(kConfig.ClientKey)
-		certFile := string(kConfig.ClientCert)
-		log.WithFields(log.Fields{
-			"Key":  keyFile,
-			"Cert": certFile,
-		}).Info("Parsing Client Key and Cert")
+// scramClient is the SCRAM conversation sarama authenticates with.
+type scramClient struct {
+	hash xscram.HashGeneratorFcn
+	conv *xscram.ClientConversation
+}
 
-		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
-	} else {
-		cert, err = tls.X509KeyPair(kConfig.ClientCert, kConfig.ClientKey)
-	}
+func (c *scramClient) Begin(user, password, authzID string) error {
+	client, err := c.hash.NewClient(user, password, authzID)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	c.conv = client.NewConversation()
+	return nil
+}
 
-	config.Net.TLS.Enable = true
-	config.Net.TLS.Config = &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		RootCAs:      certPool,
-	}
-	return config, nil
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.conv.Step(challenge)
+}
+
+func (c *scramClient) Done() bool {
+	return c.conv.Done()
 }
@@ -0,0 +1,218 @@
+package binlog
+
+import (
+	"context"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/siddontang/go-mysql/canal"
+)
+
+const (
+	// ShardRestartBackoff is how long a shard waits before its canal is restarted, it
+	// doubles with every restart up to MaxShardRestartBackoff.
+	ShardRestartBackoff    = time.Second
+	MaxShardRestartBackoff = time.Minute
+)
+
+// ShardConfig is one of the mysql servers of a sharded ecosystem. Every shard is streamed
+// by its own canal and checkpointed on its own.
+type ShardConfig struct {
+	// ID identifies the shard in events, keys, checkpoints and metrics. It is the label
+	// of the shard's mysql config unless that has one.
+	ID    string      `json:"_id"`
+	Mysql MysqlConfig `json:"_mysql"`
+	// IncludeTables and ExcludeTables are regular expressions matched against
+	// schema.table. Only the tables that match an include, or every table when there are
+	// none, and no exclude are streamed. They are applied by the handler rather than the
+	// canal so that they can be changed without restarting it. The tables dumped when the
+	// shard starts without a checkpoint are the ones they select at the time.
+	IncludeTables []string `json:"_include_tables,omitempty"`
+	ExcludeTables []string `json:"_exclude_tables,omitempty"`
+
+	// master is set when the shard is the master, see DefaultMasterTables.
+	master bool
+}
+
+// DefaultMasterTables are the tables dumped from the master when it has no table filters,
+// the ones it dumped before filters could be set.
+var DefaultMasterTables = []string{`^sales\.sales$`}
+
+// MasterShard returns the master as a shard without an id, so that its events and keys
+// don't change.
+func (s *Secrets) MasterShard() *ShardConfig {
+	return &ShardConfig{
+		Mysql:         s.Master,
+		IncludeTables: s.MasterIncludeTables,
+		ExcludeTables: s.MasterExcludeTables,
+		master:        true,
+	}
+}
+
+// SourceShards returns the shards to stream from, the master when there are none.
+func (s *Secrets) SourceShards() []*ShardConfig {
+	if len(s.Shards) == 0 {
+		return []*ShardConfig{s.MasterShard()}
+	}
+	shards := make([]*ShardConfig, len(s.Shards))
+	for i := range s.Shards {
+		shards[i] = &s.Shards[i]
+	}
+	return shards
+}
+
+// Supervise streams the shard to handler, starting from cp, until ctx is done. Whenever
+// the canal stops it is restarted, after a backoff, from the last position the handler
+// read so that the other shards keep running. It returns the errors a restart can't fix,
+// like a checkpoint of another flavor, and doesn't dump the tables again when a dump
+// stopped before a position was synced.
+func (sh *ShardConfig) Supervise(ctx context.Context, handler *kafkaBlogEventHandler, cp *Checkpoint) error {
+	backoff := ShardRestartBackoff
+	for {
+		started := time.Now()
+		dumped, err := sh.run(ctx, handler, cp)
+		if ctx.Err() != nil {
+			sh.Mysql.logger().WithField("shard", sh.ID).Info("Stopped streaming shard")
+			return nil
+		}
+		if _, ok := err.(configError); ok {
+			return err
+		}
+		synced := handler.restart()
+		if synced != nil {
+			cp = synced
+		} else if dumped {
+			return errors.Wrap(err, "dump stopped before a position was synced")
+		}
+		if time.Since(started) > MaxShardRestartBackoff {
+			// the canal ran long enough for this to be a new problem.
+			backoff = ShardRestartBackoff
+		}
+
+		shardRestarts.WithLabelValues(sh.ID).Inc()
+		sh.Mysql.logger().WithError(err).WithFields(Fields{
+			"shard":    sh.ID,
+			"retry_in": backoff,
+		}).Error("Shard canal stopped, restarting it")
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil
+		}
+		if backoff *= 2; backoff > MaxShardRestartBackoff {
+			backoff = MaxShardRestartBackoff
+		}
+	}
+}
+
+// run streams the shard until the canal stops. dumped is whether the canal was started
+// without a checkpoint, which dumps the tables first.
+func (sh *ShardConfig) run(ctx context.Context, handler EventHandler, cp *Checkpoint) (dumped bool, err error) {
+	c, removePEM, err := sh.Mysql.newCanal(sh, handler, cp == nil)
+	if err != nil {
+		return false, err
+	}
+	defer removePEM()
+
+	var once sync.Once
+	stop := make(chan struct{})
+	defer func() {
+		close(stop)
+		once.Do(func() { closeCanal(c) })
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			once.Do(func() { closeCanal(c) })
+		case <-stop:
+		}
+	}()
+	return cp == nil, sh.Mysql.runCanal(c, sh.ID, cp)
+}
+
+// configError is an error in the configuration or the checkpoint of a shard, restarting
+// the canal doesn't fix it.
+type configError struct {
+	error
+}
+
+// closeCanal closes c, canal panics when its connection to mysql has already been
+// dropped.
+func closeCanal(c *canal.Canal) {
+	defer func() {
+		if r := recover(); r != nil {
+			defaultLogger.WithField("panic", r).Debug("Canal connection already closed")
+		}
+	}()
+	c.Close()
+}
+
+// TableFilter selects the tables whose rows are streamed the same way canal's table
+// regexes do.
+type TableFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// Tables returns the shard's table filter, it is nil when every table is streamed.
+func (sh *ShardConfig) Tables() (*TableFilter, error) {
+	if len(sh.IncludeTables) == 0 && len(sh.ExcludeTables) == 0 {
+		return nil, nil
+	}
+	f := &TableFilter{}
+	for _, expr := range sh.IncludeTables {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid table regex %q", expr)
+		}
+		f.include = append(f.include, re)
+	}
+	for _, expr := range sh.ExcludeTables {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid table regex %q", expr)
+		}
+		f.exclude = append(f.exclude, re)
+	}
+	return f, nil
+}
+
+// dumped selects the tables dumped when the shard starts without a checkpoint.
+func (sh *ShardConfig) dumped() (*TableFilter, error) {
+	if sh.master && len(sh.IncludeTables) == 0 && len(sh.ExcludeTables) == 0 {
+		return (&ShardConfig{IncludeTables: DefaultMasterTables}).Tables()
+	}
+	return sh.Tables()
+}
+
+// OpenCanal streams the shard to handler, dumping the tables first, like
+// MysqlConfig.OpenCanal.
+func (sh *ShardConfig) OpenCanal(handler EventHandler) context.Context {
+	return sh.Mysql.openCanal(sh, handler, nil)
+}
+
+// Match reports whether the rows of schema.table are streamed.
+func (f *TableFilter) Match(schema, table string) bool {
+	if f == nil {
+		return true
+	}
+	key := schema + "." + table
+	included := len(f.include) == 0
+	for _, re := range f.include {
+		if re.MatchString(key) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, re := range f.exclude {
+		if re.MatchString(key) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,30 @@
+package binlog
+
+import "testing"
+
+func TestMasterDumpedTables(t *testing.T) {
+	s := &Secrets{}
+	f, err := s.MasterShard().dumped()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Match("sales", "sales") || f.Match("sales", "refunds") || f.Match("crm", "accounts") {
+		t.Error("master without filters doesn't dump only sales.sales")
+	}
+	if streamed, _ := s.MasterShard().Tables(); !streamed.Match("crm", "accounts") {
+		t.Error("master without filters doesn't stream every table")
+	}
+
+	s.MasterIncludeTables = []string{`^crm\.`}
+	if f, err = s.MasterShard().dumped(); err != nil {
+		t.Fatal(err)
+	}
+	if f.Match("sales", "sales") || !f.Match("crm", "accounts") {
+		t.Error("master doesn't dump the tables its filters select")
+	}
+
+	// a shard without filters dumps everything it streams.
+	if f, _ := (&ShardConfig{ID: "a"}).dumped(); !f.Match("crm", "accounts") {
+		t.Error("shard without filters doesn't dump every table")
+	}
+}
@@ -0,0 +1,207 @@
+//go:build ignore
+// +build ignore
+
+// gen_mariadb writes the MariaDB binlog archive in testdata/mariadb: inserts into
+// sales.sales in transactions of GTID domains 0 and 1 with a DDL statement between them.
+// It is written out event by event in the format a MariaDB 10.3 server with
+// binlog_format=ROW and binlog_checksum=CRC32 logs them, so that the tests don't need a
+// server. Replace it with a recording from a real server when one is at hand.
+//
+//	go run testdata/gen_mariadb.go
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+const (
+	serverID = 1
+	file     = "mariadb-bin.000001"
+
+	queryEvent       = 2
+	rotateEvent      = 4
+	formatEvent      = 15
+	xidEvent         = 16
+	tableMapEvent    = 19
+	writeRowsEvent   = 23
+	mariadbGTIDEvent = 162
+
+	// flags of the GTID event of a transaction and of a DDL statement.
+	flagTransactional = 0x08
+	flagStandalone    = 0x01
+
+	// sales.sales is logged as (id INT, note VARCHAR(64)) with latin1 notes.
+	tableID     = 70
+	typeLong    = 3
+	typeVarchar = 15
+	noteLength  = 64
+	// flag of the last rows event of a statement.
+	flagStmtEnd = 0x01
+)
+
+var created = time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+
+type binlog struct {
+	bytes.Buffer
+	ts uint32
+}
+
+func (b *binlog) event(typ byte, body []byte) {
+	size := uint32(19 + len(body) + 4)
+	pos := uint32(b.Len()) + size
+	header := make([]byte, 19)
+	binary.LittleEndian.PutUint32(header, b.ts)
+	header[4] = typ
+	binary.LittleEndian.PutUint32(header[5:], serverID)
+	binary.LittleEndian.PutUint32(header[9:], size)
+	binary.LittleEndian.PutUint32(header[13:], pos)
+	ev := append(header, body...)
+	sum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sum, crc32.ChecksumIEEE(ev))
+	b.Write(ev)
+	b.Write(sum)
+	b.ts++
+}
+
+func (b *binlog) format() {
+	body := make([]byte, 2+50+4+1)
+	binary.LittleEndian.PutUint16(body, 4)
+	copy(body[2:], "10.3.12-MariaDB-log")
+	binary.LittleEndian.PutUint32(body[52:], b.ts)
+	body[56] = 19
+	// post header lengths of the event types up to MariaDB's, then the checksum algorithm.
+	lengths := make([]byte, 164)
+	lengths[queryEvent-1] = 13
+	lengths[rotateEvent-1] = 8
+	lengths[formatEvent-1] = 84
+	lengths[tableMapEvent-1] = 8
+	lengths[writeRowsEvent-1] = 8
+	lengths[mariadbGTIDEvent-1] = 19
+	body = append(body, lengths...)
+	body = append(body, 1)
+	b.event(formatEvent, body)
+}
+
+func (b *binlog) gtid(domain uint32, seq uint64, flags byte) {
+	body := make([]byte, 19)
+	binary.LittleEndian.PutUint64(body, seq)
+	binary.LittleEndian.PutUint32(body[8:], domain)
+	body[12] = flags
+	b.event(mariadbGTIDEvent, body)
+}
+
+func (b *binlog) query(schema, query string) {
+	body := make([]byte, 13)
+	body[8] = byte(len(schema))
+	body = append(body, schema...)
+	body = append(body, 0)
+	body = append(body, query...)
+	b.event(queryEvent, body)
+}
+
+func (b *binlog) tableMap() {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint32(body, tableID)
+	for _, name := range []string{"sales", "sales"} {
+		body = append(body, byte(len(name)))
+		body = append(body, name...)
+		body = append(body, 0)
+	}
+	// the column count, types, metadata and which columns are nullable.
+	body = append(body, 2, typeLong, typeVarchar)
+	body = append(body, 2, noteLength, 0)
+	body = append(body, 0x02)
+	b.event(tableMapEvent, body)
+}
+
+type row struct {
+	id   int32
+	note string
+}
+
+func (b *binlog) writeRows(rows ...row) {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint32(body, tableID)
+	binary.LittleEndian.PutUint16(body[6:], flagStmtEnd)
+	// the column count and the columns present.
+	body = append(body, 2, 0x03)
+	for _, r := range rows {
+		id := make([]byte, 4)
+		binary.LittleEndian.PutUint32(id, uint32(r.id))
+		body = append(body, 0)
+		body = append(body, id...)
+		body = append(body, byte(len(r.note)))
+		body = append(body, r.note...)
+	}
+	b.event(writeRowsEvent, body)
+}
+
+func (b *binlog) xid(id uint64) {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint64(body, id)
+	b.event(xidEvent, body)
+}
+
+func (b *binlog) rotate(next string) {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint64(body, 4)
+	b.event(rotateEvent, append(body, next...))
+}
+
+func main() {
+	b := &binlog{ts: uint32(created.Unix())}
+	b.Write([]byte{0xfe, 'b', 'i', 'n'})
+	b.format()
+
+	b.gtid(0, 11, flagTransactional)
+	b.query("sales", "BEGIN")
+	b.tableMap()
+	b.writeRows(row{1, "a"})
+	b.xid(100)
+
+	b.gtid(0, 12, flagStandalone)
+	b.query("sales", "ALTER TABLE sales ADD INDEX (note)")
+
+	b.gtid(1, 5, flagTransactional)
+	b.query("sales", "BEGIN")
+	b.tableMap()
+	b.writeRows(row{2, "b"}, row{3, "c"})
+	b.xid(101)
+
+	b.gtid(0, 13, flagTransactional)
+	b.query("sales", "BEGIN")
+	b.tableMap()
+	b.writeRows(row{4, "d"})
+	b.xid(102)
+
+	b.rotate("mariadb-bin.000002")
+
+	dir := filepath.Join("testdata", "mariadb")
+	if err := ioutil.WriteFile(filepath.Join(dir, file), b.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+	manifest, err := json.MarshalIndent(map[string]interface{}{
+		"files": []map[string]interface{}{{
+			"name":       file,
+			"path":       file,
+			"pos":        b.Len(),
+			"size":       b.Len(),
+			"compressed": false,
+			"started":    created,
+			"updated":    created,
+		}},
+	}, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "manifest.json"), manifest, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,161 @@
+package binlog
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	"github.com/pkg/errors"
+	kafka "github.com/segmentio/kafka-go"
+)
+
+const DefaultReplicationFactor = 3
+
+func (k *kafkaConfig) dialOrDefault() *kafka.Dialer {
+	if k.dialer != nil {
+		return k.dialer
+	}
+	return kafka.DefaultDialer
+}
+
+// Partitions looks up the partitions of topic from the first local broker that answers.
+func (k *kafkaConfig) Partitions(ctx context.Context, topic string) ([]kafka.Partition, error) {
+	err := errors.New("no local kafka brokers configured")
+	for _, broker := range k.Brokers.Local {
+		var partitions []kafka.Partition
+		partitions, err = k.dialOrDefault().LookupPartitions(ctx, "tcp", broker, topic)
+		if err == nil {
+			return partitions, nil
+		}
+	}
+	return nil, errors.Wrapf(err, "cannot look up partitions for %s", topic)
+}
+
+// ReadTopic calls fn with every message currently in topic, one partition after the other,
+// and returns once the end of every partition has been reached.
+func (k *kafkaConfig) ReadTopic(ctx context.Context, topic string, fn func(kafka.Message) error) error {
+	partitions, err := k.Partitions(ctx, topic)
+	if err != nil {
+		return err
+	}
+	for _, p := range partitions {
+		if err := k.ReadPartition(ctx, topic, p.ID, kafka.FirstOffset, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadPartition calls fn with every message in a partition from offset up to the end of the
+// partition at the time it was called.
+func (k *kafkaConfig) ReadPartition(ctx context.Context, topic string, partition int, offset int64, fn func(kafka.Message) error) error {
+	first, last, err := k.offsets(ctx, topic, partition)
+	if err != nil {
+		return err
+	}
+	if offset < first {
+		offset = first
+	}
+	if offset >= last {
+		return nil
+	}
+	if k.TransactionalID != "" {
+		return k.readCommitted(ctx, topic, partition, offset, last, fn)
+	}
+
+	r := kafka.NewReader(*k.ReadConfiger(topic, partition))
+	defer r.Close()
+	if err := r.SetOffset(offset); err != nil {
+		return err
+	}
+
+	for {
+		m, err := r.ReadMessage(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "cannot read %s/%d", topic, partition)
+		}
+		if err := fn(m); err != nil {
+			return err
+		}
+		if m.Offset >= last-1 {
+			return nil
+		}
+	}
+}
+
+// FollowPartition calls fn with every message in a partition from offset on, waiting for
+// new ones until ctx is done or fn fails. Only committed transactions are read when the
+// pipeline writes transactions.
+func (k *kafkaConfig) FollowPartition(ctx context.Context, topic string, partition int, offset int64, fn func(kafka.Message) error) error {
+	if k.TransactionalID != "" {
+		return k.readCommitted(ctx, topic, partition, offset, -1, fn)
+	}
+
+	r := kafka.NewReader(*k.ReadConfiger(topic, partition))
+	defer r.Close()
+	if err := r.SetOffset(offset); err != nil {
+		return err
+	}
+	for {
+		m, err := r.ReadMessage(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "cannot read %s/%d", topic, partition)
+		}
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+}
+
+func (k *kafkaConfig) offsets(ctx context.Context, topic string, partition int) (first, last int64, err error) {
+	err = errors.New("no local kafka brokers configured")
+	for _, broker := range k.Brokers.Local {
+		var conn *kafka.Conn
+		conn, err = k.dialOrDefault().DialLeader(ctx, "tcp", broker, topic, partition)
+		if err != nil {
+			continue
+		}
+		first, last, err = conn.ReadOffsets()
+		conn.Close()
+		if err == nil {
+			return first, last, nil
+		}
+	}
+	return 0, 0, errors.Wrapf(err, "cannot read offsets of %s/%d", topic, partition)
+}
+
+// EnsureCompactedTopic creates topic with a compact cleanup policy if it doesn't exist.
+func (k *kafkaConfig) EnsureCompactedTopic(ctx context.Context, topic string, partitions int) error {
+	if len(k.Brokers.Local) == 0 {
+		return errors.New("no local kafka brokers configured")
+	}
+	conn, err := k.dialOrDefault().DialContext(ctx, "tcp", k.Brokers.Local[0])
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	controller, err := conn.Controller()
+	if err != nil {
+		return err
+	}
+	cconn, err := k.dialOrDefault().DialContext(ctx, "tcp", net.JoinHostPort(controller.Host, strconv.Itoa(controller.Port)))
+	if err != nil {
+		return err
+	}
+	defer cconn.Close()
+
+	replicas := k.ReplicationFactor
+	if replicas == 0 {
+		replicas = DefaultReplicationFactor
+	}
+	err = cconn.CreateTopics(kafka.TopicConfig{
+		Topic:             topic,
+		NumPartitions:     partitions,
+		ReplicationFactor: replicas,
+		ConfigEntries: []kafka.ConfigEntry{
+			{ConfigName: "cleanup.policy", ConfigValue: "compact"},
+		},
+	})
+	return errors.Wrapf(err, "cannot create compacted topic %s", topic)
+}
@@ -0,0 +1,198 @@
+package binlog
+
+import (
+	"context"
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+	kafka "github.com/segmentio/kafka-go"
+)
+
+// transactionalProducer writes every batch of messages in its own kafka transaction, so
+// that the events of a write and the checkpoint after them are committed together.
+type transactionalProducer struct {
+	producer sarama.SyncProducer
+	sync     *sync.Mutex
+}
+
+// NewTransactionalProducer creates the sarama producer of a source when a transactional
+// id is configured, and a regular producer otherwise. Creating it aborts whatever
+// transaction a previous producer of the source left open.
+func (k *kafkaConfig) NewTransactionalProducer(source string) (Producer, error) {
+	if k.TransactionalID == "" {
+		return k.NewProducer()
+	}
+	config, err := saramaConfig(k, false)
+	if err != nil {
+		return nil, err
+	}
+	config.Version = sarama.V0_11_0_0
+	config.Producer.Idempotent = true
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Net.MaxOpenRequests = 1
+	config.Producer.Transaction.ID = k.TransactionalID + "." + source
+
+	p, err := sarama.NewSyncProducer(k.Brokers.Local, config)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create transactional sarama producer")
+	}
+	return &transactionalProducer{producer: p, sync: new(sync.Mutex)}, nil
+}
+
+func (p *transactionalProducer) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	p.sync.Lock()
+	defer p.sync.Unlock()
+	if err := p.producer.BeginTxn(); err != nil {
+		return errors.Wrap(err, "cannot begin kafka transaction")
+	}
+	err := p.producer.SendMessages(producerMessages(msgs))
+	if err == nil {
+		if err = p.producer.CommitTxn(); err == nil {
+			return nil
+		}
+		err = errors.Wrap(err, "cannot commit kafka transaction")
+	}
+	if aerr := p.producer.AbortTxn(); aerr != nil {
+		return errors.Wrapf(err, "cannot abort kafka transaction (%v)", aerr)
+	}
+	return err
+}
+
+func (p *transactionalProducer) Close() error {
+	return p.producer.Close()
+}
+
+// readCommitted calls fn with the messages of committed transactions, and the ones
+// written outside of transactions, from offset up to until. It follows the partition
+// until ctx is done when until is negative. kafka-go hands out the records of aborted
+// transactions and the transaction markers as messages, so this fetches with sarama.
+func (k *kafkaConfig) readCommitted(ctx context.Context, topic string, partition int, offset, until int64, fn func(kafka.Message) error) error {
+	config, err := saramaConfig(k, false)
+	if err != nil {
+		return err
+	}
+	config.Version = sarama.V0_11_0_0
+	client, err := sarama.NewClient(k.Brokers.Local, config)
+	if err != nil {
+		return errors.Wrap(err, "cannot create sarama client")
+	}
+	defer client.Close()
+
+	p := int32(partition)
+	if offset < 0 {
+		// kafka.FirstOffset and kafka.LastOffset are the same as sarama's.
+		if offset, err = client.GetOffset(topic, p, offset); err != nil {
+			return errors.Wrapf(err, "cannot read offsets of %s/%d", topic, partition)
+		}
+	}
+
+	for until < 0 || offset < until {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		broker, err := client.Leader(topic, p)
+		if err != nil {
+			return errors.Wrapf(err, "cannot find the leader of %s/%d", topic, partition)
+		}
+		req := &sarama.FetchRequest{
+			Version:     4,
+			MaxWaitTime: 500,
+			MinBytes:    1,
+			MaxBytes:    10e6,
+			Isolation:   sarama.ReadCommitted,
+		}
+		req.AddBlock(topic, p, offset, 10e6)
+		resp, err := broker.Fetch(req)
+		if err != nil {
+			return errors.Wrapf(err, "cannot read %s/%d", topic, partition)
+		}
+		block := resp.GetBlock(topic, p)
+		if block == nil {
+			return errors.Errorf("no response for %s/%d", topic, partition)
+		}
+		if block.Err != sarama.ErrNoError {
+			return errors.Wrapf(block.Err, "cannot read %s/%d", topic, partition)
+		}
+		// nothing past the last stable offset is returned while a transaction is open, the
+		// broker holds the fetch for MaxWaitTime until there is more.
+		if offset, err = committedMessages(topic, partition, offset, block, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// committedMessages calls fn with the messages of a fetched block that are at offset or
+// later and not part of an aborted transaction. It returns the offset to fetch next.
+func committedMessages(topic string, partition int, offset int64, block *sarama.FetchResponseBlock, fn func(kafka.Message) error) (int64, error) {
+	aborted := append([]*sarama.AbortedTransaction(nil), block.AbortedTransactions...)
+	sort.Slice(aborted, func(i, j int) bool { return aborted[i].FirstOffset < aborted[j].FirstOffset })
+	abortedProducers := make(map[int64]bool)
+
+	emit := func(o int64, key, value []byte, t time.Time) error {
+		if o < offset {
+			return nil
+		}
+		offset = o + 1
+		return fn(kafka.Message{
+			Topic:     topic,
+			Partition: partition,
+			Offset:    o,
+			Key:       key,
+			Value:     value,
+			Time:      t,
+		})
+	}
+
+	for _, records := range block.RecordsSet {
+		if set := records.MsgSet; set != nil {
+			// message sets from before kafka 0.11 can't be part of a transaction.
+			for _, msgBlock := range set.Messages {
+				msgs := msgBlock.Messages()
+				for _, msg := range msgs {
+					o := msg.Offset
+					if msg.Msg.Version >= 1 {
+						// compressed messages are numbered relative to their wrapper.
+						o += msgBlock.Offset - msgs[len(msgs)-1].Offset
+					}
+					if err := emit(o, msg.Msg.Key, msg.Msg.Value, msg.Msg.Timestamp); err != nil {
+						return offset, err
+					}
+				}
+			}
+			continue
+		}
+
+		batch := records.RecordBatch
+		if batch == nil {
+			continue
+		}
+		for len(aborted) > 0 && aborted[0].FirstOffset <= batch.LastOffset() {
+			abortedProducers[aborted[0].ProducerID] = true
+			aborted = aborted[1:]
+		}
+		skip := batch.IsTransactional && abortedProducers[batch.ProducerID]
+		if batch.Control {
+			// a marker record's key is its version followed by its type, 0 for an abort.
+			if len(batch.Records) > 0 && len(batch.Records[0].Key) >= 4 && binary.BigEndian.Uint16(batch.Records[0].Key[2:]) == 0 {
+				delete(abortedProducers, batch.ProducerID)
+			}
+			skip = true
+		}
+		if !skip {
+			for _, r := range batch.Records {
+				if err := emit(batch.FirstOffset+r.OffsetDelta, r.Key, r.Value, batch.FirstTimestamp.Add(r.TimestampDelta)); err != nil {
+					return offset, err
+				}
+			}
+		}
+		if !batch.PartialTrailingRecord && batch.LastOffset() >= offset {
+			offset = batch.LastOffset() + 1
+		}
+	}
+	return offset, nil
+}
@@ -0,0 +1,98 @@
+package binlog
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TruthRecord is a row change committed by a workload along with the state it left the row
+// in, Row is nil once the row is deleted. Values are in the text form mysql returns them in.
+type TruthRecord struct {
+	Seq    int64              `json:"seq"`
+	Txn    int64              `json:"txn"`
+	Schema string             `json:"schema"`
+	Table  string             `json:"table"`
+	Action string             `json:"action"`
+	Key    string             `json:"key"`
+	Row    map[string]*string `json:"row,omitempty"`
+	Time   time.Time          `json:"time"`
+}
+
+// TruthLog is a file of the row changes committed by a workload, one json record per line,
+// in the order they were committed.
+type TruthLog struct {
+	f    *os.File
+	w    *bufio.Writer
+	seq  int64
+	txn  int64
+	sync *sync.Mutex
+}
+
+func CreateTruthLog(path string) (*TruthLog, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create ground truth log")
+	}
+	return &TruthLog{
+		f:    f,
+		w:    bufio.NewWriter(f),
+		sync: new(sync.Mutex),
+	}, nil
+}
+
+// Commit commits tx and records its changes. Transactions are committed one at a time so
+// that changes to the same row are recorded in the order they were committed.
+func (l *TruthLog) Commit(tx *sql.Tx, records []TruthRecord) error {
+	l.sync.Lock()
+	defer l.sync.Unlock()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	l.txn++
+	now := time.Now()
+	enc := json.NewEncoder(l.w)
+	for _, r := range records {
+		l.seq++
+		r.Seq, r.Txn, r.Time = l.seq, l.txn, now
+		if err := enc.Encode(r); err != nil {
+			return errors.Wrap(err, "cannot write ground truth log")
+		}
+	}
+	return l.w.Flush()
+}
+
+func (l *TruthLog) Close() error {
+	l.sync.Lock()
+	defer l.sync.Unlock()
+	if err := l.w.Flush(); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
+
+func ReadTruthLog(path string) ([]TruthRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []TruthRecord
+	d := json.NewDecoder(f)
+	for d.More() {
+		var r TruthRecord
+		if err := d.Decode(&r); err != nil {
+			return nil, errors.Wrapf(err, "invalid ground truth record after %d", len(records))
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
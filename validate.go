@@ -0,0 +1,219 @@
+package binlog
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Requirement selects the parts of the secrets a command can't run without.
+type Requirement int
+
+const (
+	RequireMysql Requirement = 1 << iota
+	RequireKafka
+	// RequireSources needs the shards or, without any, the master.
+	RequireSources
+)
+
+// ValidationErrors lists every problem found in the secrets, each naming the field by its
+// path in the secrets file.
+type ValidationErrors []string
+
+func (e ValidationErrors) Error() string {
+	return fmt.Sprintf("%d problem(s) in secrets:\n  %s", len(e), strings.Join(e, "\n  "))
+}
+
+type validator struct {
+	errs ValidationErrors
+}
+
+func (v *validator) check(ok bool, format string, args ...interface{}) {
+	if !ok {
+		v.errs = append(v.errs, fmt.Sprintf(format, args...))
+	}
+}
+
+func (v *validator) err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
+
+// Validate checks that the fields needed are set and that every field that is set is
+// usable. It returns ValidationErrors listing all the problems found.
+func (s *Secrets) Validate(need Requirement) error {
+	v := &validator{}
+	if need&RequireMysql != 0 || (need&RequireSources != 0 && len(s.Shards) == 0) {
+		s.Master.require(v, "_master_mysql")
+	}
+	if need&RequireSources != 0 {
+		for i := range s.Shards {
+			s.Shards[i].Mysql.require(v, fmt.Sprintf("_shards[%d]._mysql", i))
+		}
+	}
+	if need&RequireKafka != 0 {
+		v.check(len(s.Kafka.Brokers.Local) > 0, "_kafka._brokers._local needs at least one broker, or set KAFKA")
+	}
+	s.validateValues(v)
+	return v.err()
+}
+
+// validateValues checks the fields that are set, ParseSecrets runs it before building
+// the TLS and SASL configs from them.
+func (s *Secrets) validateValues(v *validator) {
+	s.Master.validate(v, "_master_mysql")
+	validateTables(v, "_master_include_tables", s.MasterIncludeTables)
+	validateTables(v, "_master_exclude_tables", s.MasterExcludeTables)
+	ids := make(map[string]bool, len(s.Shards))
+	for i := range s.Shards {
+		sh := &s.Shards[i]
+		path := fmt.Sprintf("_shards[%d]", i)
+		v.check(sh.ID != "", "%s._id is required", path)
+		v.check(sh.ID == "" || !ids[sh.ID], "%s._id %q is used by another shard", path, sh.ID)
+		ids[sh.ID] = true
+		sh.Mysql.validate(v, path+"._mysql")
+		validateTables(v, path+"._include_tables", sh.IncludeTables)
+		validateTables(v, path+"._exclude_tables", sh.ExcludeTables)
+	}
+	s.Kafka.validate(v)
+
+	if s.Zk.Election {
+		v.check(len(s.Zk.Nodes) > 0, "_zk._nodes needs at least one node for _zk._election, or set ZOOKEEPER_PEERS")
+		v.check(strings.HasPrefix(s.Zk.RootPath, "/"), "_zk._root_path must be an absolute path for _zk._election")
+	}
+	v.check(s.Zk.SessionTimeout >= 0, "_zk._session_timeout must not be negative")
+
+	if s.LogLevel != "" {
+		_, err := log.ParseLevel(s.LogLevel)
+		v.check(err == nil, "_log_level %q is not a logrus level", s.LogLevel)
+	}
+
+	h := &s.Heartbeat
+	v.check(h.Period >= 0, "_heartbeat._period must not be negative")
+	if h.Topic != "" {
+		checkTopic(v, "_heartbeat._topic", h.Topic)
+	}
+}
+
+// validateTables checks the regular expressions of a table filter.
+func validateTables(v *validator, path string, exprs []string) {
+	for _, re := range exprs {
+		_, err := regexp.Compile(re)
+		v.check(err == nil, "%s %q is not a regular expression: %v", path, re, err)
+	}
+}
+
+func (m *MysqlConfig) require(v *validator, path string) {
+	v.check(m.Host != "", "%s._host is required", path)
+	v.check(m.Port != 0, "%s._port is required", path)
+	v.check(m.User != "", "%s._username is required", path)
+}
+
+func (m *MysqlConfig) validate(v *validator, path string) {
+	checkPort(v, path+"._port", m.Port)
+	v.check(m.MaxConnections >= 0, "%s._max_conns must not be negative", path)
+
+	switch m.Flavor {
+	case "", MysqlFlavor, MariaDBFlavor:
+	default:
+		v.check(false, "%s._flavor %q is not %s or %s", path, m.Flavor, MysqlFlavor, MariaDBFlavor)
+	}
+	v.check(m.HeartbeatPeriod >= 0, "%s._heartbeat_period must not be negative", path)
+	v.check(m.ReadTimeout >= 0, "%s._read_timeout must not be negative", path)
+	v.check(m.HeartbeatPeriod == 0 || m.ReadTimeout == 0 || m.ReadTimeout > m.HeartbeatPeriod,
+		"%s._read_timeout must be longer than _heartbeat_period or the connection times out between heartbeats", path)
+
+	switch m.TLSMode {
+	case "", TLSDisabled, TLSSkipVerify, TLSVerifyCA, TLSVerifyFull:
+	default:
+		v.check(false, "%s._tls_mode %q is not one of %s, %s, %s or %s",
+			path, m.TLSMode, TLSDisabled, TLSSkipVerify, TLSVerifyCA, TLSVerifyFull)
+	}
+	v.check((m.ClientCert == "") == (m.ClientKey == ""),
+		"%s.client_cert and %s.client_key must be set together", path, path)
+}
+
+func (k *kafkaConfig) validate(v *validator) {
+	for _, b := range k.Brokers.Local {
+		checkBroker(v, "_kafka._brokers._local", b)
+	}
+	for _, b := range k.Brokers.Aggregate {
+		checkBroker(v, "_kafka._brokers._aggregate", b)
+	}
+
+	if k.Topic != "" {
+		// the placeholders are checked with a name that is valid in a topic.
+		checkTopic(v, "_kafka._topic", strings.NewReplacer("{schema}", "s", "{table}", "t").Replace(k.Topic))
+	}
+	if k.DeadLetterTopic != "" {
+		checkTopic(v, "_kafka._dead_letter_topic", k.DeadLetterTopic)
+	}
+	if k.CheckpointTopic != "" {
+		checkTopic(v, "_kafka._checkpoint_topic", k.CheckpointTopic)
+	}
+	v.check(k.MaxMessageBytes >= 0, "_kafka._max_message_bytes must not be negative")
+	v.check(k.FlushInterval >= 0, "_kafka._flush_interval must not be negative")
+
+	a := &k.Aggregate
+	if a.Enabled {
+		v.check(len(k.Brokers.Aggregate) > 0, "_kafka._aggregate._enabled needs at least one aggregate broker, or set KAFKA_AGGREGATE")
+	}
+	for _, re := range a.Topics {
+		_, err := regexp.Compile(re)
+		v.check(err == nil, "_kafka._aggregate._topics %q is not a regular expression: %v", re, err)
+	}
+	if a.Topic != "" {
+		checkTopic(v, "_kafka._aggregate._topic", strings.NewReplacer("{topic}", "t", "{schema}", "s", "{table}", "t").Replace(a.Topic))
+	}
+	v.check(a.MaxBuffer >= 0, "_kafka._aggregate._max_buffer must not be negative")
+
+	switch k.Producer {
+	case "", KafkaGoProducer, SaramaProducer:
+	default:
+		v.check(false, "_kafka._producer %q is not %s or %s", k.Producer, KafkaGoProducer, SaramaProducer)
+	}
+	v.check(!k.Idempotent || k.Producer == SaramaProducer, "_kafka._idempotent needs _kafka._producer %s", SaramaProducer)
+	if k.TransactionalID != "" {
+		v.check(k.Producer == SaramaProducer, "_kafka._transactional_id needs _kafka._producer %s", SaramaProducer)
+		v.check(k.Checkpoints, "_kafka._transactional_id needs _kafka._checkpoints")
+	}
+	v.check(k.ReplicationFactor >= 0, "_kafka._replication_factor must not be negative")
+
+	v.check((len(k.ClientCert) == 0) == (len(k.ClientKey) == 0),
+		"_kafka.client_cert and _kafka.client_key must be set together")
+
+	switch strings.ToUpper(k.SASL.Mechanism) {
+	case "":
+		v.check(k.SASL.Username == "" && k.SASL.Password == "", "_kafka._sasl._mechanism is required with a sasl username or password")
+	case "PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512":
+		v.check(k.SASL.Username != "", "_kafka._sasl._username is required with _kafka._sasl._mechanism")
+	default:
+		v.check(false, "_kafka._sasl._mechanism %q is not PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512", k.SASL.Mechanism)
+	}
+}
+
+// checkPort accepts 0 as the port not being set, require checks the ports that must be.
+func checkPort(v *validator, field string, port int) {
+	v.check(port >= 0 && port <= 65535, "%s %d must be between 1 and 65535, or unset", field, port)
+}
+
+func checkBroker(v *validator, field, broker string) {
+	host, port, err := net.SplitHostPort(broker)
+	if err != nil {
+		v.check(false, "%s %q is not a host:port", field, broker)
+		return
+	}
+	n, err := strconv.Atoi(port)
+	v.check(host != "" && err == nil && n > 0 && n <= 65535, "%s %q is not a host:port", field, broker)
+}
+
+func checkTopic(v *validator, field, topic string) {
+	v.check(validTopic.MatchString(topic) && topic != "." && topic != "..",
+		"%s %q is not a valid topic, use up to 249 letters, digits, '.', '_' or '-'", field, topic)
+}
@@ -0,0 +1,49 @@
+package binlog
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateMysqlPort(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		port int
+		need Requirement
+		want ValidationErrors
+	}{
+		{name: "set", port: 3306, need: RequireMysql},
+		{name: "unset and not needed", port: 0},
+		{
+			name: "unset and needed",
+			port: 0,
+			need: RequireMysql,
+			want: ValidationErrors{"_master_mysql._port is required"},
+		},
+		{
+			name: "negative",
+			port: -1,
+			want: ValidationErrors{"_master_mysql._port -1 must be between 1 and 65535, or unset"},
+		},
+		{
+			name: "too large",
+			port: 65536,
+			want: ValidationErrors{"_master_mysql._port 65536 must be between 1 and 65535, or unset"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Secrets{}
+			s.Master.Host, s.Master.User, s.Master.Port = "localhost", "blog", tc.port
+			err := s.Validate(tc.need)
+			if tc.want == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if !reflect.DeepEqual(err, tc.want) {
+				t.Errorf("got %v, want %v", err, tc.want)
+			}
+		})
+	}
+}